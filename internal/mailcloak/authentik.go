@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -60,9 +61,15 @@ func newAuthentikTokenProvider(cfg AuthentikConfig) (AuthentikTokenProvider, err
 }
 
 type authentikUser struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	IsActive bool   `json:"is_active"`
+	Username   string           `json:"username"`
+	Email      string           `json:"email"`
+	IsActive   bool             `json:"is_active"`
+	GroupsObj  []authentikGroup `json:"groups_obj"`
+	Attributes map[string]any   `json:"attributes"`
+}
+
+type authentikGroup struct {
+	Name string `json:"name"`
 }
 
 type authentikUsersResponse struct {
@@ -125,7 +132,7 @@ func (a *Authentik) ResolveUserEmail(ctx context.Context, user string) (string,
 
 	for _, u := range users {
 		if strings.EqualFold(u.Username, user) && u.IsActive && u.Email != "" {
-			email := strings.ToLower(u.Email)
+			email := normalizeEmail(u.Email)
 			a.cache.Put(key, email, true)
 			return email, true, nil
 		}
@@ -135,25 +142,112 @@ func (a *Authentik) ResolveUserEmail(ctx context.Context, user string) (string,
 }
 
 func (a *Authentik) EmailExists(ctx context.Context, email string) (bool, error) {
-	key := "email_exists:" + strings.ToLower(email)
+	email = normalizeEmail(email)
+	key := "email_exists:" + email
 	if _, ok, hit := a.cache.Get(key); hit {
 		return ok, nil
 	}
 
+	for _, form := range idpEmailForms(email) {
+		q := url.Values{}
+		q.Set("email", form)
+		q.Set("is_active", "true")
+		users, err := a.users(ctx, q)
+		if err != nil {
+			return false, err
+		}
+
+		for _, u := range users {
+			if u.IsActive && normalizeEmail(u.Email) == email {
+				a.cache.Put(key, "", true)
+				return true, nil
+			}
+		}
+	}
+	a.cache.Put(key, "", false)
+	return false, nil
+}
+
+func (a *Authentik) UserGroups(ctx context.Context, user string) ([]string, error) {
+	key := "groups_by_user:" + strings.ToLower(user)
+	if groups, _, hit := a.cache.Get(key); hit {
+		return splitCacheList(groups), nil
+	}
+
 	q := url.Values{}
-	q.Set("email", email)
+	q.Set("username", user)
 	q.Set("is_active", "true")
+	q.Set("include_groups", "true")
 	users, err := a.users(ctx, q)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
+	var names []string
 	for _, u := range users {
-		if u.IsActive && strings.EqualFold(u.Email, email) {
-			a.cache.Put(key, "", true)
+		if strings.EqualFold(u.Username, user) && u.IsActive {
+			for _, g := range u.GroupsObj {
+				names = append(names, g.Name)
+			}
+			break
+		}
+	}
+	a.cache.Put(key, joinCacheList(names), len(names) > 0)
+	return names, nil
+}
+
+// Reports whether an active user is a member of the required group.
+// Everyone may send when no group is required.
+func (a *Authentik) UserMaySend(ctx context.Context, user string) (bool, error) {
+	if a.cfg.RequiredGroup == "" {
+		return true, nil
+	}
+	groups, err := a.UserGroups(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	for _, g := range groups {
+		if strings.EqualFold(g, a.cfg.RequiredGroup) {
 			return true, nil
 		}
 	}
-	a.cache.Put(key, "", false)
 	return false, nil
 }
+
+// Find an attribute of an active user. Numbers and booleans are returned
+// in their JSON form, other non-string values are ignored.
+func (a *Authentik) UserAttribute(ctx context.Context, user, name string) (string, bool, error) {
+	key := "attr:" + name + ":" + strings.ToLower(user)
+	if val, ok, hit := a.cache.Get(key); hit {
+		return val, ok, nil
+	}
+
+	q := url.Values{}
+	q.Set("username", user)
+	q.Set("is_active", "true")
+	users, err := a.users(ctx, q)
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, u := range users {
+		if !strings.EqualFold(u.Username, user) || !u.IsActive {
+			continue
+		}
+		var val string
+		switch v := u.Attributes[name].(type) {
+		case string:
+			val = v
+		case float64:
+			val = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			val = strconv.FormatBool(v)
+		default:
+			continue
+		}
+		a.cache.Put(key, val, true)
+		return val, true, nil
+	}
+	a.cache.Put(key, "", false)
+	return "", false, nil
+}
@@ -94,6 +94,38 @@ func TestAuthentikEmailExists(t *testing.T) {
 	}
 }
 
+func TestAuthentikEmailExistsUnicodeDomain(t *testing.T) {
+	var queried []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		email := r.URL.Query().Get("email")
+		queried = append(queried, email)
+		results := []map[string]any{}
+		if email == "jörg@bücher.example" {
+			results = append(results, map[string]any{
+				"username":  "joerg",
+				"email":     "Jörg@Bücher.example",
+				"is_active": true,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"results": results})
+	}
+
+	idp, srv := newTestAuthentik(t, handler)
+	defer srv.Close()
+
+	exists, err := idp.EmailExists(context.Background(), "JÖRG@xn--bcher-kva.example")
+	if err != nil {
+		t.Fatalf("EmailExists error: %v", err)
+	}
+	if !exists {
+		t.Fatalf("expected email stored with a U-label domain to exist")
+	}
+	if len(queried) != 2 || queried[0] != "jörg@xn--bcher-kva.example" {
+		t.Fatalf("unexpected queries: %q", queried)
+	}
+}
+
 func TestNewAuthentikMissingToken(t *testing.T) {
 	_, err := NewAuthentik(AuthentikConfig{
 		BaseURL:         "http://authentik.local",
@@ -188,3 +220,99 @@ func TestAuthentikMalformedBaseURLReturnsError(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthentikUserGroups(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/api/v3/core/users/" || q.Get("include_groups") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"results": []map[string]any{{
+				"username":  "bob",
+				"is_active": true,
+				"groups_obj": []map[string]any{
+					{"name": "staff"},
+					{"name": "mail-admins"},
+				},
+			}},
+		})
+	}
+
+	idp, srv := newTestAuthentik(t, handler)
+	defer srv.Close()
+
+	groups, err := idp.UserGroups(context.Background(), "bob")
+	if err != nil {
+		t.Fatalf("UserGroups error: %v", err)
+	}
+	if strings.Join(groups, ",") != "staff,mail-admins" {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+}
+
+func TestAuthentikUserMaySend(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		groups := map[string][]map[string]any{
+			"bob":   {{"name": "staff"}, {"name": "Mail-Users"}},
+			"carol": {{"name": "staff"}},
+		}
+		name := r.URL.Query().Get("username")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"results": []map[string]any{{
+				"username":   name,
+				"is_active":  true,
+				"groups_obj": groups[name],
+			}},
+		})
+	}
+
+	idp, srv := newTestAuthentik(t, handler)
+	defer srv.Close()
+	ctx := context.Background()
+
+	if ok, err := idp.UserMaySend(ctx, "carol"); err != nil || !ok {
+		t.Fatalf("expected everyone to send without required group, got %v %v", ok, err)
+	}
+
+	idp.cfg.RequiredGroup = "mail-users"
+	for user, want := range map[string]bool{"bob": true, "carol": false} {
+		ok, err := idp.UserMaySend(ctx, user)
+		if err != nil {
+			t.Fatalf("UserMaySend(%s) error: %v", user, err)
+		}
+		if ok != want {
+			t.Fatalf("UserMaySend(%s) = %v, want %v", user, ok, want)
+		}
+	}
+}
+
+func TestAuthentikUserAttribute(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"results": []map[string]any{{
+				"username":  "bob",
+				"is_active": true,
+				"attributes": map[string]any{
+					"mailMaxSize": 1048576,
+					"nested":      map[string]any{"a": 1},
+				},
+			}},
+		})
+	}
+
+	idp, srv := newTestAuthentik(t, handler)
+	defer srv.Close()
+
+	val, ok, err := idp.UserAttribute(context.Background(), "bob", "mailMaxSize")
+	if err != nil || !ok || val != "1048576" {
+		t.Fatalf("unexpected attribute: %q %v %v", val, ok, err)
+	}
+	if _, ok, err := idp.UserAttribute(context.Background(), "bob", "nested"); err != nil || ok {
+		t.Fatalf("expected non-scalar attribute to be ignored, got %v %v", ok, err)
+	}
+}
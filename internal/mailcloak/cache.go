@@ -1,6 +1,7 @@
 package mailcloak
 
 import (
+	"strings"
 	"sync"
 	"time"
 )
@@ -36,3 +37,15 @@ func (c *Cache) Put(key, val string, ok bool) {
 	c.m[key] = cacheItem{val: val, ok: ok, expires: time.Now().Add(c.ttl)}
 	c.mu.Unlock()
 }
+
+// Lists are cached as newline separated values
+func joinCacheList(vals []string) string {
+	return strings.Join(vals, "\n")
+}
+
+func splitCacheList(val string) []string {
+	if val == "" {
+		return nil
+	}
+	return strings.Split(val, "\n")
+}
@@ -0,0 +1,36 @@
+package mailcloak
+
+import (
+	"log"
+	"strings"
+)
+
+// Pseudo SASL method of apps identified by a TLS client certificate
+const certMethod = "ccert"
+
+// Fingerprints are compared as lowercase hex without colons, Postfix sends
+// them as uppercase pairs separated by colons
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
+
+// Maps the TLS client certificate of a client that did not authenticate
+// with SASL to the app it belongs to. The request then carries the "ccert"
+// method and the app id, and is checked like a plain/login app. Unknown
+// certificates leave the client unauthenticated.
+func certIdentity(cfg *Config, db *MailcloakDB, req *policyRequest) string {
+	if req.SASLMethod != "" || (req.CertFingerprint == "" && req.CertPubkeyFingerprint == "") {
+		return "DUNNO"
+	}
+	appID, ok, err := db.AppForCert(req.CertFingerprint, req.CertPubkeyFingerprint)
+	if err != nil {
+		log.Printf("sqlite app certificate lookup error: %v", err)
+		return reply(cfg, req, reasonInternalError)
+	}
+	if !ok {
+		return "DUNNO"
+	}
+	log.Printf("policy client certificate: app=%s subject=%q", appID, req.CertSubject)
+	req.SASLMethod, req.SASLUser = certMethod, appID
+	return "DUNNO"
+}
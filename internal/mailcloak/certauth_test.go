@@ -0,0 +1,66 @@
+package mailcloak
+
+import (
+	"testing"
+
+	"mailcloak/internal/mailcloak/testutil"
+)
+
+func TestPolicyClientCertificateApps(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertApp(t, sqlDB, "printer", true)
+	testutil.InsertAppFrom(t, sqlDB, "printer", "printer@example.com", true)
+	testutil.InsertAppCert(t, sqlDB, "printer", "cert", "abcdef0123456789abcdef0123456789")
+	testutil.InsertApp(t, sqlDB, "scanner", true)
+	testutil.InsertAppFrom(t, sqlDB, "scanner", "scanner@example.com", true)
+	testutil.InsertAppCert(t, sqlDB, "scanner", "pubkey", "00112233445566778899aabbccddeeff")
+	testutil.InsertApp(t, sqlDB, "retired", false)
+	testutil.InsertAppFrom(t, sqlDB, "retired", "retired@example.com", true)
+	testutil.InsertAppCert(t, sqlDB, "retired", "cert", "ffeeddccbbaa99887766554433221100")
+
+	cfg := testPolicyConfig("tempfail")
+	fakeIDP := &testutil.FakeIdentityResolver{}
+
+	cases := []struct {
+		name      string
+		sender    string
+		cert      string
+		pubkey    string
+		saslUser  string
+		expect    string
+		expectApp string
+	}{
+		{name: "certificate fingerprint", sender: "printer@example.com", cert: "AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89", expect: "DUNNO", expectApp: "printer"},
+		{name: "sender of another app", sender: "scanner@example.com", cert: "AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89", expect: "553 5.7.1 Sender not owned by authenticated user", expectApp: "printer"},
+		{name: "public key fingerprint", sender: "scanner@example.com", cert: "99:99:99:99", pubkey: "00:11:22:33:44:55:66:77:88:99:AA:BB:CC:DD:EE:FF", expect: "DUNNO", expectApp: "scanner"},
+		{name: "certificate fingerprint is not a public key", sender: "scanner@example.com", pubkey: "AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89", expect: "553 5.7.1 Sending from local domains requires authentication"},
+		{name: "unknown certificate", sender: "printer@example.com", cert: "01:02:03:04", expect: "553 5.7.1 Sending from local domains requires authentication"},
+		{name: "disabled app", sender: "retired@example.com", cert: "FF:EE:DD:CC:BB:AA:99:88:77:66:55:44:33:22:11:00", expect: "553 5.7.1 Sending from local domains requires authentication"},
+		{name: "sasl takes precedence", sender: "printer@example.com", cert: "AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89", saslUser: "scanner", expect: "553 5.7.1 Sender not owned by authenticated user", expectApp: "scanner"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &policyRequest{
+				State:                 "MAIL",
+				Sender:                tc.sender,
+				CertFingerprint:       tc.cert,
+				CertPubkeyFingerprint: tc.pubkey,
+			}
+			if tc.saslUser != "" {
+				req.SASLMethod, req.SASLUser = "plain", tc.saslUser
+			}
+			sess := &policySession{}
+			if got := sess.decide(cfg, db, fakeIDP, req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+			if req.SASLUser != tc.expectApp {
+				t.Fatalf("expected app %q, got %q", tc.expectApp, req.SASLUser)
+			}
+		})
+	}
+}
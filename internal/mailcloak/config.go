@@ -3,8 +3,11 @@ package mailcloak
 import (
 	"fmt"
 	"log"
+	"net/netip"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,12 +18,20 @@ type KeycloakConfig struct {
 	ClientID        string `yaml:"client_id"`
 	ClientSecret    string `yaml:"client_secret"`
 	CacheTTLSeconds int    `yaml:"cache_ttl_seconds"`
+
+	// Only users holding this role may send: a realm role, or a client
+	// role of RequiredRoleClient (a clientId) when set. Empty disables.
+	RequiredRole       string `yaml:"required_role"`
+	RequiredRoleClient string `yaml:"required_role_client"`
 }
 
 type AuthentikConfig struct {
 	BaseURL         string `yaml:"base_url"`
 	APIToken        string `yaml:"api_token"`
 	CacheTTLSeconds int    `yaml:"cache_ttl_seconds"`
+
+	// Only members of this group may send. Empty disables.
+	RequiredGroup string `yaml:"required_group"`
 }
 
 type IDPConfig struct {
@@ -29,6 +40,167 @@ type IDPConfig struct {
 	Authentik AuthentikConfig `yaml:"authentik"`
 }
 
+// Per-message limits checked at END-OF-MESSAGE, 0 = unlimited
+type MessageLimits struct {
+	MaxRecipients int   `yaml:"max_recipients"`
+	MaxSize       int64 `yaml:"max_size"` // bytes
+}
+
+// Sliding-window sending limits per sasl_username, 0 = unlimited
+type RateLimits struct {
+	MessagesPerMinute   int `yaml:"messages_per_minute"`
+	MessagesPerHour     int `yaml:"messages_per_hour"`
+	MessagesPerDay      int `yaml:"messages_per_day"`
+	RecipientsPerMinute int `yaml:"recipients_per_minute"`
+	RecipientsPerHour   int `yaml:"recipients_per_hour"`
+	RecipientsPerDay    int `yaml:"recipients_per_day"`
+}
+
+// Greylisting of unauthenticated inbound mail: the first delivery attempt
+// for a (client network, sender, recipient) triplet is deferred
+type GreylistConfig struct {
+	Enabled          bool `yaml:"enabled"`
+	DelaySeconds     int  `yaml:"delay_seconds"`      // minimum wait before a retry is accepted
+	RetryWindowHours int  `yaml:"retry_window_hours"` // triplets not retried in time start over
+	WhitelistDays    int  `yaml:"whitelist_days"`     // passed client/sender pairs skip greylisting
+	IPv4Prefix       int  `yaml:"ipv4_prefix"`        // client network size, e.g. 24
+	IPv6Prefix       int  `yaml:"ipv6_prefix"`
+}
+
+type PolicyConfig struct {
+	IDPFailureMode      string `yaml:"idp_failure_mode"`      // "tempfail" or "dunno"
+	KeycloakFailureMode string `yaml:"keycloak_failure_mode"` // legacy
+
+	// "enforce" (default) or "monitor": decisions are computed and logged,
+	// but DUNNO is returned instead of rejecting
+	Mode string `yaml:"mode"`
+	// Per-domain override of Mode, keyed by mail domain
+	DomainModes map[string]string `yaml:"domain_modes"`
+
+	MessageLimits struct {
+		Users MessageLimits `yaml:"users"` // xoauth2/oauthbearer submissions
+		Apps  MessageLimits `yaml:"apps"`  // plain/login submissions
+	} `yaml:"message_limits"`
+
+	// IdP user attribute holding a message size limit in bytes, overriding
+	// message_limits and the domain limit. Empty disables.
+	SizeLimitAttribute string `yaml:"size_limit_attribute"`
+
+	// Record accepted messages in the message_log table at END-OF-MESSAGE
+	RecordMessages bool `yaml:"record_messages"`
+
+	// Defaults for authenticated users and apps, apps may override them
+	RateLimits RateLimits `yaml:"rate_limits"`
+
+	// Null sender (MAIL FROM:<>) of authenticated submissions: "reject"
+	// (default) or "allow". Unauthenticated bounces are always accepted.
+	NullSender struct {
+		Users string `yaml:"users"`
+		Apps  string `yaml:"apps"`
+	} `yaml:"null_sender"`
+
+	// Only applies to unauthenticated clients
+	Greylisting GreylistConfig `yaml:"greylisting"`
+
+	// Postfix recipient_delimiter: address extensions are ignored when
+	// looking up users and aliases, e.g. "+" for alice+news@example.com
+	RecipientDelimiter string `yaml:"recipient_delimiter"`
+
+	// IdP groups named <prefix><address> may send as that address, e.g.
+	// "sendas-" for a group "sendas-support@example.com". Empty disables.
+	SendAsGroupPrefix string `yaml:"send_as_group_prefix"`
+
+	// Members of this IdP group may only send to local domains, like the
+	// users listed with "mailcloakctl internal-only". Empty disables.
+	InternalOnlyGroup string `yaml:"internal_only_group"`
+
+	// Warn in the log this many days before an app or app sender expires,
+	// 0 disables the warnings
+	AppExpiryWarningDays int `yaml:"app_expiry_warning_days"`
+
+	// Overrides of the built-in replies, keyed by reason
+	Replies map[string]ReplyTemplate `yaml:"replies"`
+	// Quarantine instead of rejecting, keyed by reason: "hold" puts the
+	// message on the Postfix hold queue, "filter transport:destination"
+	// routes it to a content filter. Held messages are recorded in the
+	// held_messages table.
+	ReasonActions map[string]string `yaml:"reason_actions"`
+
+	// Declarative rules evaluated "before" (default) or "instead" of the built-in checks
+	RulesMode string       `yaml:"rules_mode"`
+	Rules     []PolicyRule `yaml:"rules"`
+
+	// Headers identifying who submitted an accepted authenticated message
+	PrependHeaders struct {
+		Enabled           bool   `yaml:"enabled"`
+		UserHeader        string `yaml:"user_header"`
+		AppHeader         string `yaml:"app_header"`
+		IncludeAuthMethod bool   `yaml:"include_auth_method"`
+	} `yaml:"prepend_headers"`
+}
+
+// Request attributes a policy rule matches on. Values within a list are
+// alternatives, all non-empty lists must match.
+type RuleMatch struct {
+	ProtocolState   []string `yaml:"protocol_state"`
+	SASLMethod      []string `yaml:"sasl_method"` // "none" matches unauthenticated clients
+	ClientAddress   []string `yaml:"client_address"`
+	SenderDomain    []string `yaml:"sender_domain"`
+	RecipientDomain []string `yaml:"recipient_domain"`
+	IDPGroup        []string `yaml:"idp_group"`
+
+	networks []netip.Prefix // parsed ClientAddress
+}
+
+type PolicyRule struct {
+	Name   string    `yaml:"name"`
+	Match  RuleMatch `yaml:"match"`
+	Action string    `yaml:"action"` // accept, reject, defer, hold, prepend
+	Code   string    `yaml:"code"`   // reject/defer, e.g. "554 5.7.1"
+	Text   string    `yaml:"text"`   // reject/defer/hold
+	Header string    `yaml:"header"` // prepend, e.g. "X-Foo: bar"
+}
+
+// Connection limits applied to both the policy and socketmap listeners.
+// Settings left out of the config file get defaultServerConfig, an
+// explicit 0 disables the timeout or limit.
+type ServerConfig struct {
+	IdleTimeoutSeconds  int `yaml:"idle_timeout_seconds"`
+	ReadTimeoutSeconds  int `yaml:"read_timeout_seconds"`
+	WriteTimeoutSeconds int `yaml:"write_timeout_seconds"`
+	MaxConnections      int `yaml:"max_connections"`       // per listener, 0 = unlimited
+	QueueTimeoutSeconds int `yaml:"queue_timeout_seconds"` // wait for a free slot before refusing, 0 = refuse at once
+}
+
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		// Postfix closes idle policy connections after smtpd_policy_service_max_idle (300s)
+		IdleTimeoutSeconds:  300,
+		ReadTimeoutSeconds:  10,
+		WriteTimeoutSeconds: 10,
+		// Postfix keeps one connection open per smtpd process, leave room
+		// above the process limits of smtp and submission together
+		MaxConnections:      500,
+		QueueTimeoutSeconds: 5,
+	}
+}
+
+func (s ServerConfig) idleTimeout() time.Duration {
+	return time.Duration(s.IdleTimeoutSeconds) * time.Second
+}
+
+func (s ServerConfig) readTimeout() time.Duration {
+	return time.Duration(s.ReadTimeoutSeconds) * time.Second
+}
+
+func (s ServerConfig) writeTimeout() time.Duration {
+	return time.Duration(s.WriteTimeoutSeconds) * time.Second
+}
+
+func (s ServerConfig) queueTimeout() time.Duration {
+	return time.Duration(s.QueueTimeoutSeconds) * time.Second
+}
+
 type Config struct {
 	Daemon struct {
 		User string `yaml:"user"`
@@ -41,10 +213,7 @@ type Config struct {
 		Path string `yaml:"path"`
 	} `yaml:"sqlite"`
 
-	Policy struct {
-		IDPFailureMode      string `yaml:"idp_failure_mode"`      // "tempfail" or "dunno"
-		KeycloakFailureMode string `yaml:"keycloak_failure_mode"` // legacy
-	} `yaml:"policy"`
+	Policy PolicyConfig `yaml:"policy"`
 
 	Sockets struct {
 		PolicySocket     string `yaml:"policy_socket"`
@@ -53,6 +222,8 @@ type Config struct {
 		SocketOwnerGroup string `yaml:"socket_owner_group"`
 		SocketMode       string `yaml:"socket_mode"`
 	} `yaml:"sockets"`
+
+	Server ServerConfig `yaml:"server"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -60,7 +231,7 @@ func LoadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	var cfg Config
+	cfg := Config{Server: defaultServerConfig()}
 	if err := yaml.Unmarshal(b, &cfg); err != nil {
 		return nil, err
 	}
@@ -83,10 +254,43 @@ func LoadConfig(path string) (*Config, error) {
 			log.Printf("config: policy.idp_failure_mode not set, defaulting to %s", cfg.Policy.IDPFailureMode)
 		}
 	}
+	if err := validateMessageLimits(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateNullSender(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateGreylisting(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validatePrependHeaders(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validatePolicyRules(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validatePolicyModes(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateReplies(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateReasonActions(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Policy.AppExpiryWarningDays < 0 {
+		return nil, fmt.Errorf("policy.app_expiry_warning_days must not be negative")
+	}
+	if strings.ContainsAny(cfg.Policy.RecipientDelimiter, "@ \t\r\n") {
+		return nil, fmt.Errorf("invalid policy.recipient_delimiter %q", cfg.Policy.RecipientDelimiter)
+	}
 	if cfg.Daemon.User == "" {
 		cfg.Daemon.User = "mailcloak"
 		log.Printf("config: daemon.user not set, defaulting to %s", cfg.Daemon.User)
 	}
+	if err := validateServerConfig(&cfg); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
@@ -122,6 +326,255 @@ func normalizeIDPProvider(cfg *Config) {
 	cfg.IDP.Provider = strings.TrimSpace(strings.ToLower(cfg.IDP.Provider))
 }
 
+func validateMessageLimits(cfg *Config) error {
+	limits := cfg.Policy.MessageLimits
+	if limits.Users.MaxRecipients < 0 || limits.Users.MaxSize < 0 ||
+		limits.Apps.MaxRecipients < 0 || limits.Apps.MaxSize < 0 {
+		return fmt.Errorf("policy.message_limits must not be negative")
+	}
+	rl := cfg.Policy.RateLimits
+	if rl.MessagesPerMinute < 0 || rl.MessagesPerHour < 0 || rl.MessagesPerDay < 0 ||
+		rl.RecipientsPerMinute < 0 || rl.RecipientsPerHour < 0 || rl.RecipientsPerDay < 0 {
+		return fmt.Errorf("policy.rate_limits must not be negative")
+	}
+	return nil
+}
+
+func validateNullSender(cfg *Config) error {
+	ns := &cfg.Policy.NullSender
+	for _, v := range []*string{&ns.Users, &ns.Apps} {
+		*v = strings.ToLower(strings.TrimSpace(*v))
+		switch *v {
+		case "":
+			*v = "reject"
+		case "reject", "allow":
+		default:
+			return fmt.Errorf("unsupported policy.null_sender setting %q", *v)
+		}
+	}
+	return nil
+}
+
+func validateGreylisting(cfg *Config) error {
+	gl := &cfg.Policy.Greylisting
+	if gl.DelaySeconds < 0 || gl.RetryWindowHours < 0 || gl.WhitelistDays < 0 {
+		return fmt.Errorf("policy.greylisting settings must not be negative")
+	}
+	if gl.IPv4Prefix < 0 || gl.IPv4Prefix > 32 || gl.IPv6Prefix < 0 || gl.IPv6Prefix > 128 {
+		return fmt.Errorf("invalid policy.greylisting network prefix")
+	}
+	if !gl.Enabled {
+		return nil
+	}
+	if gl.DelaySeconds == 0 {
+		gl.DelaySeconds = 300
+		log.Printf("config: policy.greylisting.delay_seconds not set, defaulting to %d", gl.DelaySeconds)
+	}
+	if gl.RetryWindowHours == 0 {
+		gl.RetryWindowHours = 24
+		log.Printf("config: policy.greylisting.retry_window_hours not set, defaulting to %d", gl.RetryWindowHours)
+	}
+	if gl.WhitelistDays == 0 {
+		gl.WhitelistDays = 35
+		log.Printf("config: policy.greylisting.whitelist_days not set, defaulting to %d", gl.WhitelistDays)
+	}
+	if gl.IPv4Prefix == 0 {
+		gl.IPv4Prefix = 24
+	}
+	if gl.IPv6Prefix == 0 {
+		gl.IPv6Prefix = 64
+	}
+	if time.Duration(gl.DelaySeconds)*time.Second >= time.Duration(gl.RetryWindowHours)*time.Hour {
+		return fmt.Errorf("policy.greylisting.delay_seconds must be shorter than retry_window_hours")
+	}
+	return nil
+}
+
+func validatePrependHeaders(cfg *Config) error {
+	ph := &cfg.Policy.PrependHeaders
+	if !ph.Enabled {
+		return nil
+	}
+	if ph.UserHeader == "" {
+		ph.UserHeader = "X-Mailcloak-Authenticated-User"
+	}
+	if ph.AppHeader == "" {
+		ph.AppHeader = "X-Mailcloak-App-Id"
+	}
+	if ph.UserHeader == "X-Mailcloak-Authenticated-User" || ph.AppHeader == "X-Mailcloak-App-Id" {
+		log.Printf("config: policy.prepend_headers uses a public header name, Postfix header_checks must drop client-supplied copies")
+	}
+	for _, name := range []string{ph.UserHeader, ph.AppHeader} {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q in policy.prepend_headers", name)
+		}
+	}
+	return nil
+}
+
+func validatePolicyModes(cfg *Config) error {
+	p := &cfg.Policy
+	p.Mode = strings.ToLower(strings.TrimSpace(p.Mode))
+	switch p.Mode {
+	case "":
+		p.Mode = "enforce"
+	case "enforce", "monitor":
+	default:
+		return fmt.Errorf("unsupported policy.mode %q", p.Mode)
+	}
+	if p.Mode == "monitor" {
+		log.Printf("config: policy.mode is monitor, rejections are logged but not enforced")
+	}
+
+	modes := make(map[string]string, len(p.DomainModes))
+	for domain, mode := range p.DomainModes {
+		domain = normalizeDomain(strings.TrimSpace(domain))
+		mode = strings.ToLower(strings.TrimSpace(mode))
+		if mode != "enforce" && mode != "monitor" {
+			return fmt.Errorf("unsupported policy.domain_modes mode %q for %s", mode, domain)
+		}
+		modes[domain] = mode
+	}
+	p.DomainModes = modes
+	return nil
+}
+
+var (
+	ruleReplyCodeRe = regexp.MustCompile(`^([45])[0-9][0-9] ([45])\.[0-9]{1,3}\.[0-9]{1,3}$`)
+	ruleStates      = map[string]bool{"CONNECT": true, "EHLO": true, "HELO": true, "MAIL": true, "RCPT": true, "DATA": true, "END-OF-MESSAGE": true, "VRFY": true, "ETRN": true}
+)
+
+// Normalizes the rules and checks that they can be evaluated
+func validatePolicyRules(cfg *Config) error {
+	p := &cfg.Policy
+	p.RulesMode = strings.ToLower(strings.TrimSpace(p.RulesMode))
+	switch p.RulesMode {
+	case "":
+		p.RulesMode = "before"
+	case "before", "instead":
+	default:
+		return fmt.Errorf("unsupported policy.rules_mode %q", p.RulesMode)
+	}
+
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if err := validatePolicyRule(r); err != nil {
+			return fmt.Errorf("policy.rules[%d] (%s): %w", i, r.Name, err)
+		}
+	}
+	return nil
+}
+
+func validatePolicyRule(r *PolicyRule) error {
+	m := &r.Match
+	for i, state := range m.ProtocolState {
+		m.ProtocolState[i] = strings.ToUpper(strings.TrimSpace(state))
+		if !ruleStates[m.ProtocolState[i]] {
+			return fmt.Errorf("unknown protocol_state %q", state)
+		}
+	}
+	for i, method := range m.SASLMethod {
+		m.SASLMethod[i] = strings.ToLower(strings.TrimSpace(method))
+	}
+	for i, domain := range m.SenderDomain {
+		m.SenderDomain[i] = normalizeDomain(strings.TrimSpace(domain))
+	}
+	for i, domain := range m.RecipientDomain {
+		m.RecipientDomain[i] = normalizeDomain(strings.TrimSpace(domain))
+	}
+	m.networks = nil
+	for _, cidr := range m.ClientAddress {
+		prefix, err := parseNetwork(cidr)
+		if err != nil {
+			return err
+		}
+		m.networks = append(m.networks, prefix)
+	}
+
+	r.Action = strings.ToLower(strings.TrimSpace(r.Action))
+	switch r.Action {
+	case "accept":
+	case "reject", "defer":
+		want := "5"
+		if r.Action == "defer" {
+			want = "4"
+		}
+		if r.Code == "" {
+			r.Code = map[string]string{"reject": "550 5.7.1", "defer": "450 4.7.1"}[r.Action]
+		}
+		sub := ruleReplyCodeRe.FindStringSubmatch(r.Code)
+		if sub == nil || sub[1] != want || sub[2] != want {
+			return fmt.Errorf("%s code must look like \"%sxx %s.x.x\", got %q", r.Action, want, want, r.Code)
+		}
+		if r.Text == "" {
+			r.Text = "Rejected by policy rule " + r.Name
+			if r.Action == "defer" {
+				r.Text = "Deferred by policy rule " + r.Name
+			}
+		}
+	case "hold":
+		if r.Text == "" {
+			r.Text = "held by policy rule " + r.Name
+		}
+	case "prepend":
+		name, _, ok := strings.Cut(r.Header, ":")
+		if !ok || !validHeaderName(name) {
+			return fmt.Errorf("prepend header must look like \"Name: value\", got %q", r.Header)
+		}
+	default:
+		return fmt.Errorf("unsupported action %q", r.Action)
+	}
+	if strings.ContainsAny(r.Text+r.Header, "\r\n") {
+		return fmt.Errorf("text and header must be a single line")
+	}
+	return nil
+}
+
+// Accepts a CIDR or a single address
+func parseNetwork(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid network %q: %w", s, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network %q: %w", s, err)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// RFC 5322 field name: printable US-ASCII except colon
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+func validateServerConfig(cfg *Config) error {
+	srv := &cfg.Server
+	if srv.IdleTimeoutSeconds < 0 || srv.ReadTimeoutSeconds < 0 || srv.WriteTimeoutSeconds < 0 ||
+		srv.MaxConnections < 0 || srv.QueueTimeoutSeconds < 0 {
+		return fmt.Errorf("server settings must not be negative")
+	}
+	if srv.MaxConnections == 0 {
+		log.Printf("config: server.max_connections is 0, connections are not limited")
+	}
+	return nil
+}
+
 func validateIDPConfig(cfg *Config) error {
 	const defaultCacheTTLSeconds = 120
 	switch cfg.IDP.Provider {
@@ -133,6 +586,9 @@ func validateIDPConfig(cfg *Config) error {
 			cfg.IDP.Keycloak.CacheTTLSeconds = defaultCacheTTLSeconds
 			log.Printf("config: idp.keycloak.cache_ttl_seconds not set, defaulting to %d", cfg.IDP.Keycloak.CacheTTLSeconds)
 		}
+		if cfg.IDP.Keycloak.RequiredRoleClient != "" && cfg.IDP.Keycloak.RequiredRole == "" {
+			return fmt.Errorf("idp.keycloak.required_role_client requires idp.keycloak.required_role")
+		}
 	case "authentik":
 		if cfg.IDP.Authentik.BaseURL == "" || cfg.IDP.Authentik.APIToken == "" {
 			return fmt.Errorf("missing idp.authentik.base_url or idp.authentik.api_token")
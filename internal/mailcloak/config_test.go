@@ -84,6 +84,125 @@ daemon:
 	if cfg.Daemon.User != "daemon-user" {
 		t.Fatalf("expected daemon user daemon-user, got %q", cfg.Daemon.User)
 	}
+	if cfg.Server.IdleTimeoutSeconds != 300 || cfg.Server.ReadTimeoutSeconds != 10 || cfg.Server.WriteTimeoutSeconds != 10 {
+		t.Fatalf("unexpected default server timeouts: %+v", cfg.Server)
+	}
+	if cfg.Server.MaxConnections != 500 || cfg.Server.QueueTimeoutSeconds != 5 {
+		t.Fatalf("unexpected default server limits: %+v", cfg.Server)
+	}
+}
+
+func TestLoadConfigServerZeroDisablesLimits(t *testing.T) {
+	p := writeTestConfig(t, `
+idp:
+  provider: authentik
+  authentik:
+    base_url: http://authentik.local
+    api_token: token
+sqlite:
+  path: /tmp/mailcloak.db
+server:
+  idle_timeout_seconds: 0
+  max_connections: 0
+  queue_timeout_seconds: 0
+`)
+
+	cfg, err := LoadConfig(p)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.Server.IdleTimeoutSeconds != 0 || cfg.Server.MaxConnections != 0 || cfg.Server.QueueTimeoutSeconds != 0 {
+		t.Fatalf("expected explicit zeros to be kept: %+v", cfg.Server)
+	}
+	if cfg.Server.ReadTimeoutSeconds != 10 || cfg.Server.WriteTimeoutSeconds != 10 {
+		t.Fatalf("expected unset timeouts to get their defaults: %+v", cfg.Server)
+	}
+}
+
+func TestLoadConfigPrependHeadersDefaults(t *testing.T) {
+	p := writeTestConfig(t, `
+idp:
+  provider: authentik
+  authentik:
+    base_url: http://authentik.local
+    api_token: token
+sqlite:
+  path: /tmp/mailcloak.db
+policy:
+  prepend_headers:
+    enabled: true
+    app_header: X-Sending-App
+`)
+
+	cfg, err := LoadConfig(p)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	ph := cfg.Policy.PrependHeaders
+	if ph.UserHeader != "X-Mailcloak-Authenticated-User" || ph.AppHeader != "X-Sending-App" {
+		t.Fatalf("unexpected prepend headers: %+v", ph)
+	}
+}
+
+func TestLoadConfigPolicyModes(t *testing.T) {
+	p := writeTestConfig(t, `
+idp:
+  provider: authentik
+  authentik:
+    base_url: http://authentik.local
+    api_token: token
+sqlite:
+  path: /tmp/mailcloak.db
+policy:
+  domain_modes:
+    Example.COM: Monitor
+`)
+
+	cfg, err := LoadConfig(p)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.Policy.Mode != "enforce" {
+		t.Fatalf("expected policy.mode to default to enforce, got %q", cfg.Policy.Mode)
+	}
+	if cfg.Policy.NullSender.Users != "reject" || cfg.Policy.NullSender.Apps != "reject" {
+		t.Fatalf("expected null senders to be rejected by default, got %+v", cfg.Policy.NullSender)
+	}
+	if cfg.Policy.DomainModes["example.com"] != "monitor" {
+		t.Fatalf("unexpected domain modes: %v", cfg.Policy.DomainModes)
+	}
+}
+
+func TestLoadConfigGreylistingDefaults(t *testing.T) {
+	p := writeTestConfig(t, `
+idp:
+  provider: authentik
+  authentik:
+    base_url: http://authentik.local
+    api_token: token
+sqlite:
+  path: /tmp/mailcloak.db
+policy:
+  greylisting:
+    enabled: true
+    delay_seconds: 120
+`)
+
+	cfg, err := LoadConfig(p)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	want := GreylistConfig{
+		Enabled:          true,
+		DelaySeconds:     120,
+		RetryWindowHours: 24,
+		WhitelistDays:    35,
+		IPv4Prefix:       24,
+		IPv6Prefix:       64,
+	}
+	if cfg.Policy.Greylisting != want {
+		t.Fatalf("unexpected greylisting config: %+v", cfg.Policy.Greylisting)
+	}
 }
 
 func TestLoadConfigErrors(t *testing.T) {
@@ -143,6 +262,119 @@ sqlite:
 `,
 			wantErr: "missing idp.authentik.base_url or idp.authentik.api_token",
 		},
+		{
+			name: "negative server setting",
+			body: `
+idp:
+  provider: authentik
+  authentik:
+    base_url: http://authentik.local
+    api_token: token
+sqlite:
+  path: /tmp/mailcloak.db
+server:
+  max_connections: -1
+`,
+			wantErr: "server settings must not be negative",
+		},
+		{
+			name: "unsupported domain mode",
+			body: `
+idp:
+  provider: authentik
+  authentik:
+    base_url: http://authentik.local
+    api_token: token
+sqlite:
+  path: /tmp/mailcloak.db
+policy:
+  domain_modes:
+    example.com: dry-run
+`,
+			wantErr: "unsupported policy.domain_modes mode",
+		},
+		{
+			name: "greylisting delay exceeds retry window",
+			body: `
+idp:
+  provider: authentik
+  authentik:
+    base_url: http://authentik.local
+    api_token: token
+sqlite:
+  path: /tmp/mailcloak.db
+policy:
+  greylisting:
+    enabled: true
+    delay_seconds: 7200
+    retry_window_hours: 1
+`,
+			wantErr: "delay_seconds must be shorter than retry_window_hours",
+		},
+		{
+			name: "keycloak role client without role",
+			body: `
+idp:
+  provider: keycloak
+  keycloak:
+    base_url: http://keycloak.local
+    realm: realm
+    required_role_client: mail
+sqlite:
+  path: /tmp/mailcloak.db
+`,
+			wantErr: "required_role_client requires idp.keycloak.required_role",
+		},
+		{
+			name: "unsupported null sender setting",
+			body: `
+idp:
+  provider: authentik
+  authentik:
+    base_url: http://authentik.local
+    api_token: token
+sqlite:
+  path: /tmp/mailcloak.db
+policy:
+  null_sender:
+    apps: bounce
+`,
+			wantErr: "unsupported policy.null_sender setting",
+		},
+		{
+			name: "negative message limit",
+			body: `
+idp:
+  provider: authentik
+  authentik:
+    base_url: http://authentik.local
+    api_token: token
+sqlite:
+  path: /tmp/mailcloak.db
+policy:
+  message_limits:
+    apps:
+      max_recipients: -5
+`,
+			wantErr: "policy.message_limits must not be negative",
+		},
+		{
+			name: "invalid prepend header name",
+			body: `
+idp:
+  provider: authentik
+  authentik:
+    base_url: http://authentik.local
+    api_token: token
+sqlite:
+  path: /tmp/mailcloak.db
+policy:
+  prepend_headers:
+    enabled: true
+    user_header: "X-Bad Header:"
+`,
+			wantErr: "invalid header name",
+		},
 	}
 
 	for _, tc := range cases {
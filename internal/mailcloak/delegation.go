@@ -0,0 +1,52 @@
+package mailcloak
+
+import (
+	"log"
+	"slices"
+	"strings"
+)
+
+// Send-as delegation for OIDC users: the sender is granted to the user, to
+// one of their IdP groups, or through a group named after the address with
+// policy.send_as_group_prefix (e.g. "sendas-support@example.com").
+func sendAsPolicy(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest, senders []string) string {
+	prefix := strings.ToLower(cfg.Policy.SendAsGroupPrefix)
+
+	var groups []string
+	groupsLoaded := false
+	for _, addr := range senders {
+		users, grantGroups, err := db.SendAsGrantees(addr)
+		if err != nil {
+			log.Printf("sqlite send-as lookup error: %v", err)
+			return reply(cfg, req, reasonInternalError)
+		}
+		if slices.ContainsFunc(users, func(u string) bool { return strings.EqualFold(u, req.SASLUser) }) {
+			log.Printf("policy send-as: sasl=%s sender=%s grant=user", req.SASLUser, req.Sender)
+			return "DUNNO"
+		}
+		if len(grantGroups) == 0 && prefix == "" {
+			continue
+		}
+
+		if !groupsLoaded {
+			groupsLoaded = true
+			groups, err = userGroups(idp, req)
+			if err != nil {
+				log.Printf("idp groups lookup error for %s: %v", req.SASLUser, err)
+				if failOpen(cfg, req.SenderDomain, req.RecipientDomain) {
+					return "DUNNO"
+				}
+				return reply(cfg, req, reasonLookupFailure)
+			}
+		}
+		for _, g := range groups {
+			g = strings.ToLower(g)
+			if slices.ContainsFunc(grantGroups, func(gg string) bool { return strings.EqualFold(gg, g) }) ||
+				(prefix != "" && strings.HasPrefix(g, prefix) && normalizeEmail(g[len(prefix):]) == addr) {
+				log.Printf("policy send-as: sasl=%s sender=%s grant=group:%s", req.SASLUser, req.Sender, g)
+				return "DUNNO"
+			}
+		}
+	}
+	return reply(cfg, req, reasonSenderNotOwned)
+}
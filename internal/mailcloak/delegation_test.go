@@ -0,0 +1,88 @@
+package mailcloak
+
+import (
+	"errors"
+	"testing"
+
+	"mailcloak/internal/mailcloak/testutil"
+)
+
+func TestPolicySendAsDelegation(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertSendAs(t, sqlDB, "user", "alice", "support@example.com", true)
+	testutil.InsertSendAs(t, sqlDB, "user", "alice", "old@example.com", false)
+	testutil.InsertSendAs(t, sqlDB, "group", "Sales", "sales@example.com", true)
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser: map[string]string{"alice": "alice@example.com", "bob": "bob@example.com"},
+		GroupsByUser: map[string][]string{
+			"bob": {"sales", "sendas-billing@example.com"},
+		},
+	}
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.SendAsGroupPrefix = "sendas-"
+	cfg.Policy.RecipientDelimiter = "+"
+
+	cases := []struct {
+		name   string
+		user   string
+		sender string
+		expect string
+	}{
+		{name: "user grant", user: "alice", sender: "support@example.com", expect: "DUNNO"},
+		{name: "user grant with extension", user: "alice", sender: "support+tickets@example.com", expect: "DUNNO"},
+		{name: "disabled grant", user: "alice", sender: "old@example.com", expect: "553 5.7.1 Sender not owned by authenticated user"},
+		{name: "grant for another user", user: "bob", sender: "support@example.com", expect: "553 5.7.1 Sender not owned by authenticated user"},
+		{name: "group grant", user: "bob", sender: "sales@example.com", expect: "DUNNO"},
+		{name: "group naming convention", user: "bob", sender: "billing@example.com", expect: "DUNNO"},
+		{name: "other user's address", user: "bob", sender: "alice@example.com", expect: "553 5.7.1 Sender not owned by authenticated user"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &policyRequest{State: "MAIL", SASLMethod: "xoauth2", SASLUser: tc.user, Sender: tc.sender}
+			if got := senderPolicy(cfg, db, fakeIDP, req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+
+	// Without the prefix, group names are not interpreted
+	cfg.Policy.SendAsGroupPrefix = ""
+	req := &policyRequest{State: "MAIL", SASLMethod: "xoauth2", SASLUser: "bob", Sender: "billing@example.com"}
+	if got := senderPolicy(cfg, db, fakeIDP, req); got != "553 5.7.1 Sender not owned by authenticated user" {
+		t.Fatalf("expected naming convention to be disabled, got %q", got)
+	}
+}
+
+func TestPolicySendAsGroupLookupError(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertSendAs(t, sqlDB, "group", "sales", "sales@example.com", true)
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser:   map[string]string{"bob": "bob@example.com"},
+		UserGroupsErr: errors.New("idp down"),
+	}
+	req := &policyRequest{State: "MAIL", SASLMethod: "xoauth2", SASLUser: "bob", Sender: "sales@example.com"}
+
+	if got := senderPolicy(testPolicyConfig("tempfail"), db, fakeIDP, req); got != "451 4.3.0 Temporary authentication/lookup failure" {
+		t.Fatalf("expected tempfail, got %q", got)
+	}
+	if got := senderPolicy(testPolicyConfig("dunno"), db, fakeIDP, req); got != "DUNNO" {
+		t.Fatalf("expected DUNNO in dunno mode, got %q", got)
+	}
+
+	// No group grant and no naming convention: groups are not looked up
+	req.Sender = "nobody@example.com"
+	if got := senderPolicy(testPolicyConfig("tempfail"), db, fakeIDP, req); got != "553 5.7.1 Sender not owned by authenticated user" {
+		t.Fatalf("expected rejection without group lookup, got %q", got)
+	}
+}
@@ -0,0 +1,53 @@
+package mailcloak
+
+import (
+	"log"
+	"slices"
+)
+
+// Loads the settings of the recipient and sender domains, consulted before
+// the global policy settings
+func loadDomainSettings(cfg *Config, db *MailcloakDB, req *policyRequest) string {
+	for _, d := range []struct {
+		addr     string
+		settings *DomainSettings
+	}{
+		{req.Recipient, &req.RecipientDomain},
+		{req.Sender, &req.SenderDomain},
+	} {
+		domain, ok := domainFromEmail(d.addr)
+		if !ok {
+			continue
+		}
+		s, err := db.DomainSettings(domain)
+		if err != nil {
+			log.Printf("sqlite domain settings lookup error: %v", err)
+			return reply(cfg, req, reasonInternalError)
+		}
+		*d.settings = s
+	}
+	return "DUNNO"
+}
+
+// Whether lookup failures let the request through: the failure mode of the
+// first domain that sets one, then policy.idp_failure_mode. A check passes
+// the domain it is about first, e.g. the sender domain for sender checks.
+func failOpen(cfg *Config, domains ...DomainSettings) bool {
+	for _, d := range domains {
+		if d.FailureMode == "tempfail" || d.FailureMode == "dunno" {
+			return d.FailureMode == "dunno"
+		}
+	}
+	return cfg.Policy.IDPFailureMode == "dunno"
+}
+
+// Rejects authenticated submissions from a sender domain that only allows
+// other SASL methods
+func domainAuthPolicy(cfg *Config, req *policyRequest) string {
+	allowed := req.SenderDomain.AuthMethods
+	if len(allowed) == 0 || slices.Contains(allowed, req.SASLMethod) {
+		return "DUNNO"
+	}
+	log.Printf("policy auth method denied: sasl_method=%s sasl=%s sender=%s", req.SASLMethod, req.SASLUser, req.Sender)
+	return reply(cfg, req, reasonAuthMethodDenied)
+}
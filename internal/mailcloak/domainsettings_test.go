@@ -0,0 +1,132 @@
+package mailcloak
+
+import (
+	"errors"
+	"testing"
+
+	"mailcloak/internal/mailcloak/testutil"
+)
+
+func TestPolicyDomainSettings(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertDomain(t, sqlDB, "lenient.com", true)
+	testutil.InsertDomain(t, sqlDB, "strict.com", true)
+	testutil.InsertDomain(t, sqlDB, "trial.com", true)
+	testutil.SetDomainSetting(t, sqlDB, "lenient.com", "failure_mode", "dunno")
+	testutil.SetDomainSetting(t, sqlDB, "strict.com", "failure_mode", "tempfail")
+	testutil.SetDomainSetting(t, sqlDB, "strict.com", "auth_methods", "xoauth2, OAuthBearer")
+	testutil.SetDomainSetting(t, sqlDB, "strict.com", "max_recipients", 2)
+	testutil.SetDomainSetting(t, sqlDB, "trial.com", "policy_mode", "monitor")
+	testutil.InsertApp(t, sqlDB, "myapp", true)
+	testutil.InsertAppFrom(t, sqlDB, "myapp", "myapp@strict.com", true)
+	testutil.InsertAppFrom(t, sqlDB, "myapp", "myapp@example.com", true)
+
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.MessageLimits.Users.MaxRecipients = 10
+
+	down := &testutil.FakeIdentityResolver{EmailExistsErr: errors.New("idp down")}
+	allDown := &testutil.FakeIdentityResolver{
+		ResolveUserEmailErr: errors.New("idp down"),
+		EmailExistsErr:      errors.New("idp down"),
+		UserGroupsErr:       errors.New("idp down"),
+		UserMaySendErr:      errors.New("idp down"),
+	}
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser:    map[string]string{"alice": "alice@strict.com"},
+		EmailExistsSet: map[string]bool{"alice@strict.com": true},
+	}
+
+	cases := []struct {
+		name   string
+		idp    IdentityResolver
+		req    policyRequest
+		expect string
+	}{
+		{
+			name:   "global failure mode",
+			idp:    down,
+			req:    policyRequest{State: "RCPT", Sender: "x@remote.net", Recipient: "bob@example.com"},
+			expect: "451 4.3.0 Temporary authentication/lookup failure",
+		},
+		{
+			name:   "domain fails open",
+			idp:    down,
+			req:    policyRequest{State: "RCPT", Sender: "x@remote.net", Recipient: "bob@lenient.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "strict sender to lenient recipient",
+			idp:    allDown,
+			req:    policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "ceo", Sender: "ceo@strict.com", Recipient: "x@lenient.com"},
+			expect: "451 4.3.0 Temporary authentication/lookup failure",
+		},
+		{
+			name:   "strict sender at mail stage",
+			idp:    allDown,
+			req:    policyRequest{State: "MAIL", SASLMethod: "xoauth2", SASLUser: "ceo", Sender: "ceo@strict.com"},
+			expect: "451 4.3.0 Temporary authentication/lookup failure",
+		},
+		{
+			name:   "lenient sender to strict recipient",
+			idp:    allDown,
+			req:    policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "bob", Sender: "bob@lenient.com", Recipient: "x@strict.com"},
+			expect: "451 4.3.0 Temporary authentication/lookup failure",
+		},
+		{
+			name:   "lenient sender to remote recipient",
+			idp:    allDown,
+			req:    policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "bob", Sender: "bob@lenient.com", Recipient: "x@remote.net"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "domain monitor mode",
+			idp:    fakeIDP,
+			req:    policyRequest{State: "RCPT", Sender: "x@remote.net", Recipient: "nobody@trial.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "auth method not allowed for sender domain",
+			idp:    fakeIDP,
+			req:    policyRequest{State: "MAIL", SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@strict.com"},
+			expect: "553 5.7.1 Authentication method not allowed for this sender domain",
+		},
+		{
+			name:   "auth method allowed for sender domain",
+			idp:    fakeIDP,
+			req:    policyRequest{State: "MAIL", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice@strict.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "unrestricted sender domain",
+			idp:    fakeIDP,
+			req:    policyRequest{State: "MAIL", SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@example.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "domain recipient limit",
+			idp:    fakeIDP,
+			req:    policyRequest{State: "END-OF-MESSAGE", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice@strict.com", RecipientCount: 3},
+			expect: "552 5.5.3 Too many recipients",
+		},
+		{
+			name:   "global recipient limit",
+			idp:    fakeIDP,
+			req:    policyRequest{State: "END-OF-MESSAGE", SASLMethod: "xoauth2", SASLUser: "bob", Sender: "bob@example.com", RecipientCount: 3},
+			expect: "DUNNO",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sess := &policySession{}
+			req := tc.req
+			if got := sess.decide(cfg, db, tc.idp, &req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
@@ -1,11 +1,103 @@
 package mailcloak
 
-import "strings"
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Canonical form of a domain: lowercase A-labels, so that "bücher.example"
+// and "xn--bcher-kva.example" are the same key. Names that are not valid
+// IDNs are only lowercased.
+func normalizeDomain(domain string) string {
+	if isASCII(domain) {
+		return strings.ToLower(domain)
+	}
+	if a, err := idna.Lookup.ToASCII(domain); err == nil {
+		return a
+	}
+	return strings.ToLower(domain)
+}
+
+// Canonical form of an address (SMTPUTF8): the local part lowercased with
+// the simple Unicode case mapping, so "ß" and "ss" stay distinct, and in
+// NFC, and the domain as normalizeDomain
+func normalizeEmail(email string) string {
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 {
+		return normalizeLocalPart(email)
+	}
+	return normalizeLocalPart(email[:at]) + "@" + normalizeDomain(email[at+1:])
+}
+
+// Lowercased with the simple case mapping, rune by rune, as mailcloakctl
+// does: U+0130 (İ), whose full lowercase is two runes, is kept as is.
+func normalizeLocalPart(local string) string {
+	local = strings.Map(func(r rune) rune {
+		if r == '\u0130' {
+			return r
+		}
+		return unicode.ToLower(r)
+	}, local)
+	if isASCII(local) {
+		return local
+	}
+	return norm.NFC.String(local)
+}
+
+// Forms of a normalized address to search the IdP for: as is, then with
+// its domain in U-labels, as IdPs store addresses the way they were typed
+func idpEmailForms(email string) []string {
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 || !strings.Contains(email[at:], "xn--") {
+		return []string{email}
+	}
+	u, err := idna.Lookup.ToUnicode(email[at+1:])
+	if err != nil {
+		return []string{email}
+	}
+	return []string{email, email[:at+1] + u}
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
 
 func domainFromEmail(email string) (string, bool) {
 	at := strings.LastIndexByte(email, '@')
 	if at <= 0 || at >= len(email)-1 {
 		return "", false
 	}
-	return strings.ToLower(email[at+1:]), true
+	return normalizeDomain(email[at+1:]), true
+}
+
+// Split the extension off the local part using any of the Postfix
+// recipient_delimiter characters: "alice+news@example.com" gives
+// "alice@example.com" and "+news". The extension keeps its delimiter.
+func splitAddressExtension(email, delimiters string) (string, string) {
+	at := strings.LastIndexByte(email, '@')
+	if delimiters == "" || at <= 0 {
+		return email, ""
+	}
+	i := strings.IndexAny(email[:at], delimiters)
+	if i <= 0 {
+		return email, ""
+	}
+	return email[:i] + email[at:], email[i:at]
+}
+
+// The address as given, then without its extension if it has one
+func addressVariants(email, delimiters string) []string {
+	if base, ext := splitAddressExtension(email, delimiters); ext != "" {
+		return []string{email, base}
+	}
+	return []string{email}
 }
@@ -0,0 +1,63 @@
+package mailcloak
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitAddressExtension(t *testing.T) {
+	cases := []struct {
+		email, delimiters string
+		base, ext         string
+	}{
+		{"alice+news@example.com", "+", "alice@example.com", "+news"},
+		{"alice-news+x@example.com", "+-", "alice@example.com", "-news+x"},
+		{"alice+news@example.com", "", "alice+news@example.com", ""},
+		{"alice@example.com", "+", "alice@example.com", ""},
+		{"+news@example.com", "+", "+news@example.com", ""},
+		{"alice+@example.com", "+", "alice@example.com", "+"},
+		{"not-an-address", "-", "not-an-address", ""},
+	}
+	for _, tc := range cases {
+		base, ext := splitAddressExtension(tc.email, tc.delimiters)
+		if base != tc.base || ext != tc.ext {
+			t.Fatalf("splitAddressExtension(%q, %q) = %q, %q; want %q, %q", tc.email, tc.delimiters, base, ext, tc.base, tc.ext)
+		}
+	}
+
+	if got := addressVariants("alice+news@example.com", "+"); !slices.Equal(got, []string{"alice+news@example.com", "alice@example.com"}) {
+		t.Fatalf("unexpected variants: %v", got)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := map[string]string{
+		"Alice@Example.COM":           "alice@example.com",
+		"alice@Bücher.Example":        "alice@xn--bcher-kva.example",
+		"alice@XN--BCHER-KVA.example": "alice@xn--bcher-kva.example",
+		"JÖRG@bücher.example":         "jörg@xn--bcher-kva.example",
+		"jo\u0308rg@bücher.example":   "jörg@xn--bcher-kva.example",
+		"Straße@example.com":          "straße@example.com",
+		"İLKER@example.com":           "İlker@example.com",
+		"ΣΟΦΙΑΣ@example.com":          "σοφιασ@example.com",
+		"user@under_score.example":    "user@under_score.example",
+		"user@bad domäin.example":     "user@bad domäin.example",
+		"":                            "",
+		"NoDomain":                    "nodomain",
+	}
+	for in, want := range cases {
+		if got := normalizeEmail(in); got != want {
+			t.Errorf("normalizeEmail(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	if got, _ := domainFromEmail("bob@Bücher.example"); got != "xn--bcher-kva.example" {
+		t.Fatalf("unexpected domain %q", got)
+	}
+	if got := idpEmailForms("jörg@xn--bcher-kva.example"); !slices.Equal(got, []string{"jörg@xn--bcher-kva.example", "jörg@bücher.example"}) {
+		t.Fatalf("unexpected idp forms: %v", got)
+	}
+	if got := idpEmailForms("alice@example.com"); !slices.Equal(got, []string{"alice@example.com"}) {
+		t.Fatalf("unexpected idp forms: %v", got)
+	}
+}
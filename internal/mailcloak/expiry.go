@@ -0,0 +1,58 @@
+package mailcloak
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const appExpiryCheckInterval = time.Hour
+
+// Logs a warning for apps and sender addresses expiring within
+// policy.app_expiry_warning_days, once at startup and then hourly
+func watchAppExpiry(ctx context.Context, cfg *Config, db *MailcloakDB, done <-chan struct{}) {
+	if cfg.Policy.AppExpiryWarningDays <= 0 {
+		return
+	}
+	ticker := time.NewTicker(appExpiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		warnExpiringApps(cfg, db, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the number of warnings logged
+func warnExpiringApps(cfg *Config, db *MailcloakDB, now time.Time) int {
+	window := time.Duration(cfg.Policy.AppExpiryWarningDays) * 24 * time.Hour
+	expiring, err := db.AppsExpiringBefore(now.Add(window))
+	if err != nil {
+		log.Printf("sqlite app expiry lookup error: %v", err)
+		return 0
+	}
+
+	warned := 0
+	for _, e := range expiring {
+		// Expired more than a window ago: warned about long enough
+		if e.ExpiresAt.Before(now.Add(-window)) {
+			continue
+		}
+		what := "app " + e.AppID
+		if e.FromAddr != "" {
+			what += " sender " + e.FromAddr
+		}
+		if e.ExpiresAt.After(now) {
+			log.Printf("warning: %s expires in %s (%s)", what, e.ExpiresAt.Sub(now).Round(time.Minute), e.ExpiresAt.UTC().Format(time.RFC3339))
+		} else {
+			log.Printf("warning: %s expired at %s", what, e.ExpiresAt.UTC().Format(time.RFC3339))
+		}
+		warned++
+	}
+	return warned
+}
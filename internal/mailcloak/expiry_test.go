@@ -0,0 +1,33 @@
+package mailcloak
+
+import (
+	"testing"
+	"time"
+
+	"mailcloak/internal/mailcloak/testutil"
+)
+
+func TestWarnExpiringApps(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	now := time.Now()
+
+	testutil.InsertApp(t, sqlDB, "soon", true)
+	testutil.SetAppValidity(t, sqlDB, "soon", "", 0, now.Add(3*24*time.Hour).Unix())
+	testutil.InsertApp(t, sqlDB, "just-expired", true)
+	testutil.SetAppValidity(t, sqlDB, "just-expired", "", 0, now.Add(-time.Hour).Unix())
+	testutil.InsertApp(t, sqlDB, "long-expired", true)
+	testutil.SetAppValidity(t, sqlDB, "long-expired", "", 0, now.Add(-60*24*time.Hour).Unix())
+	testutil.InsertApp(t, sqlDB, "later", true)
+	testutil.SetAppValidity(t, sqlDB, "later", "", 0, now.Add(60*24*time.Hour).Unix())
+	testutil.InsertApp(t, sqlDB, "disabled", false)
+	testutil.SetAppValidity(t, sqlDB, "disabled", "", 0, now.Add(24*time.Hour).Unix())
+
+	cfg := &Config{}
+	cfg.Policy.AppExpiryWarningDays = 14
+	if got := warnExpiringApps(cfg, db, now); got != 2 {
+		t.Fatalf("expected 2 warnings, got %d", got)
+	}
+}
@@ -0,0 +1,114 @@
+package mailcloak
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const greylistExpiryInterval = time.Hour
+
+func (g GreylistConfig) delay() time.Duration {
+	return time.Duration(g.DelaySeconds) * time.Second
+}
+
+func (g GreylistConfig) retryWindow() time.Duration {
+	return time.Duration(g.RetryWindowHours) * time.Hour
+}
+
+func (g GreylistConfig) whitelistTTL() time.Duration {
+	return time.Duration(g.WhitelistDays) * 24 * time.Hour
+}
+
+// Returns the client network a client address belongs to, so that retries
+// from another host of the same mail cluster match. Unparsable addresses
+// such as "unknown" are used as is.
+func greylistNetwork(cfg *Config, client string) string {
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		return strings.ToLower(client)
+	}
+	addr = addr.Unmap()
+	bits := cfg.Policy.Greylisting.IPv6Prefix
+	if addr.Is4() {
+		bits = cfg.Policy.Greylisting.IPv4Prefix
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
+
+// Defers the first delivery attempt of an unauthenticated client for a
+// (client network, sender, recipient) triplet. A retry after the delay
+// passes and whitelists the client network and sender. Greylisting is an
+// optimisation, lookup errors let the mail through.
+func greylistPolicy(cfg *Config, db *MailcloakDB, req *policyRequest, now time.Time) string {
+	gl := cfg.Policy.Greylisting
+	if !gl.Enabled || req.SASLMethod != "" {
+		return "DUNNO"
+	}
+
+	clientNet := greylistNetwork(cfg, req.ClientAddress)
+	sender, rcpt := req.Sender, req.Recipient
+
+	whitelisted, err := db.GreylistWhitelisted(clientNet, sender, now, now.Add(-gl.whitelistTTL()))
+	if err != nil {
+		log.Printf("sqlite greylist whitelist lookup error: %v", err)
+		return "DUNNO"
+	}
+	if whitelisted {
+		return "DUNNO"
+	}
+
+	first, err := db.GreylistTriplet(clientNet, sender, rcpt, now, now.Add(-gl.retryWindow()))
+	if err != nil {
+		log.Printf("sqlite greylist lookup error: %v", err)
+		return "DUNNO"
+	}
+	if wait := gl.delay() - now.Sub(first); wait > 0 {
+		log.Printf("policy greylisted: client=%s sender=%s rcpt=%s retry_in=%s", clientNet, sender, rcpt, wait.Round(time.Second))
+		return reply(cfg, req, reasonGreylisted)
+	}
+
+	if err := db.GreylistPass(clientNet, sender, rcpt, now); err != nil {
+		log.Printf("sqlite greylist update error: %v", err)
+	}
+	log.Printf("policy greylist passed: client=%s sender=%s rcpt=%s", clientNet, sender, rcpt)
+	return "DUNNO"
+}
+
+// Drops triplets that were never retried in time and whitelist entries
+// not used for policy.greylisting.whitelist_days, at startup and then hourly
+func watchGreylistExpiry(ctx context.Context, cfg *Config, db *MailcloakDB, done <-chan struct{}) {
+	if !cfg.Policy.Greylisting.Enabled {
+		return
+	}
+	ticker := time.NewTicker(greylistExpiryInterval)
+	defer ticker.Stop()
+	for {
+		expireGreylist(cfg, db, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func expireGreylist(cfg *Config, db *MailcloakDB, now time.Time) {
+	gl := cfg.Policy.Greylisting
+	n, err := db.ExpireGreylist(now.Add(-gl.retryWindow()), now.Add(-gl.whitelistTTL()))
+	if err != nil {
+		log.Printf("sqlite greylist expiry error: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("greylist: expired %d entries", n)
+	}
+}
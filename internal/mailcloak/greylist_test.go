@@ -0,0 +1,121 @@
+package mailcloak
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"mailcloak/internal/mailcloak/testutil"
+)
+
+func testGreylistConfig() *Config {
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.Greylisting = GreylistConfig{
+		Enabled:          true,
+		DelaySeconds:     300,
+		RetryWindowHours: 24,
+		WhitelistDays:    35,
+		IPv4Prefix:       24,
+		IPv6Prefix:       64,
+	}
+	return cfg
+}
+
+func TestGreylistNetwork(t *testing.T) {
+	cfg := testGreylistConfig()
+	cases := map[string]string{
+		"192.0.2.77":        "192.0.2.0/24",
+		"::ffff:192.0.2.77": "192.0.2.0/24",
+		"2001:db8:1:2:3::4": "2001:db8:1:2::/64",
+		"unknown":           "unknown",
+		"2001:DB8::1%eth0":  "2001:db8::/64",
+		"198.51.100.1":      "198.51.100.0/24",
+	}
+	for in, want := range cases {
+		if got := greylistNetwork(cfg, in); got != want {
+			t.Errorf("greylistNetwork(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestGreylistPolicy(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	cfg := testGreylistConfig()
+	now := time.Now()
+	req := func(client, sender, rcpt string) *policyRequest {
+		return &policyRequest{State: "RCPT", ClientAddress: client, Sender: sender, Recipient: rcpt}
+	}
+
+	// First attempt is deferred, an early retry too
+	if got := greylistPolicy(cfg, db, req("192.0.2.10", "a@remote.net", "bob@example.com"), now); !strings.HasPrefix(got, "450 4.7.1") {
+		t.Fatalf("expected greylisting, got %q", got)
+	}
+	if got := greylistPolicy(cfg, db, req("192.0.2.10", "a@remote.net", "bob@example.com"), now.Add(time.Minute)); !strings.HasPrefix(got, "450 ") {
+		t.Fatalf("expected early retry to be greylisted, got %q", got)
+	}
+
+	// A retry after the delay from another host of the same network passes
+	if got := greylistPolicy(cfg, db, req("192.0.2.11", "a@remote.net", "bob@example.com"), now.Add(6*time.Minute)); got != "DUNNO" {
+		t.Fatalf("expected retry to pass, got %q", got)
+	}
+
+	// The client network and sender are now whitelisted for other recipients
+	if got := greylistPolicy(cfg, db, req("192.0.2.12", "a@remote.net", "carol@example.com"), now.Add(7*time.Minute)); got != "DUNNO" {
+		t.Fatalf("expected whitelisted sender to pass, got %q", got)
+	}
+	if got := greylistPolicy(cfg, db, req("198.51.100.1", "a@remote.net", "carol@example.com"), now.Add(7*time.Minute)); !strings.HasPrefix(got, "450 ") {
+		t.Fatalf("expected other network to be greylisted, got %q", got)
+	}
+
+	// Authenticated clients are never greylisted
+	authed := req("203.0.113.1", "alice@example.com", "x@remote.net")
+	authed.SASLMethod = "xoauth2"
+	if got := greylistPolicy(cfg, db, authed, now); got != "DUNNO" {
+		t.Fatalf("expected authenticated client to skip greylisting, got %q", got)
+	}
+
+	// A retry after the retry window starts over
+	testutil.InsertGreylistTriplet(t, sqlDB, "203.0.113.0/24", "late@remote.net", "bob@example.com", now.Add(-48*time.Hour).Unix())
+	if got := greylistPolicy(cfg, db, req("203.0.113.5", "late@remote.net", "bob@example.com"), now); !strings.HasPrefix(got, "450 ") {
+		t.Fatalf("expected stale triplet to start over, got %q", got)
+	}
+
+	cfg.Policy.Greylisting.Enabled = false
+	if got := greylistPolicy(cfg, db, req("203.0.113.5", "new@remote.net", "bob@example.com"), now); got != "DUNNO" {
+		t.Fatalf("expected disabled greylisting to pass, got %q", got)
+	}
+}
+
+func TestExpireGreylist(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	cfg := testGreylistConfig()
+	now := time.Now()
+
+	testutil.InsertGreylistTriplet(t, sqlDB, "192.0.2.0/24", "old@remote.net", "bob@example.com", now.Add(-25*time.Hour).Unix())
+	testutil.InsertGreylistTriplet(t, sqlDB, "192.0.2.0/24", "new@remote.net", "bob@example.com", now.Add(-time.Hour).Unix())
+	if err := db.GreylistPass("198.51.100.0/24", "stale@remote.net", "bob@example.com", now.Add(-40*24*time.Hour)); err != nil {
+		t.Fatalf("greylist pass: %v", err)
+	}
+	if err := db.GreylistPass("198.51.100.0/24", "fresh@remote.net", "bob@example.com", now.Add(-24*time.Hour)); err != nil {
+		t.Fatalf("greylist pass: %v", err)
+	}
+
+	expireGreylist(cfg, db, now)
+
+	var pending, whitelisted int
+	if err := sqlDB.QueryRow(`SELECT COUNT(*) FROM greylist`).Scan(&pending); err != nil {
+		t.Fatalf("count greylist: %v", err)
+	}
+	if err := sqlDB.QueryRow(`SELECT COUNT(*) FROM greylist_whitelist`).Scan(&whitelisted); err != nil {
+		t.Fatalf("count greylist whitelist: %v", err)
+	}
+	if pending != 1 || whitelisted != 1 {
+		t.Fatalf("expected 1 pending and 1 whitelisted entry, got %d and %d", pending, whitelisted)
+	}
+}
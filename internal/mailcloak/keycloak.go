@@ -77,6 +77,14 @@ type kcUser struct {
 }
 
 func (k *Keycloak) adminGet(ctx context.Context, bearer, path string, q url.Values) ([]kcUser, error) {
+	var users []kcUser
+	if err := k.adminGetJSON(ctx, bearer, path, q, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (k *Keycloak) adminGetJSON(ctx context.Context, bearer, path string, q url.Values, out any) error {
 	base := strings.TrimRight(k.cfg.BaseURL, "/") +
 		"/admin/realms/" + url.PathEscape(k.cfg.Realm) + path
 
@@ -91,20 +99,19 @@ func (k *Keycloak) adminGet(ctx context.Context, bearer, path string, q url.Valu
 	resp, err := k.hc.Do(req)
 	if err != nil {
 		log.Printf("keycloak admin request error: %v", err)
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode/100 != 2 {
 		b, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
 		log.Printf("keycloak admin non-2xx: %d", resp.StatusCode)
-		return nil, fmt.Errorf("admin http %d: %s", resp.StatusCode, string(b))
+		return fmt.Errorf("admin http %d: %s", resp.StatusCode, string(b))
 	}
-	var users []kcUser
-	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
 		log.Printf("keycloak admin decode error: %v", err)
-		return nil, err
+		return err
 	}
-	return users, nil
+	return nil
 }
 
 // Find primary email of user (username/uuid)
@@ -138,7 +145,7 @@ func (k *Keycloak) ResolveUserEmail(ctx context.Context, user string) (string, b
 
 	for _, u := range users {
 		if strings.EqualFold(u.Username, user) && u.Enabled && u.Email != "" {
-			email := strings.ToLower(u.Email)
+			email := normalizeEmail(u.Email)
 			k.cache.Put(key, email, true)
 			return email, true, nil
 		}
@@ -149,7 +156,8 @@ func (k *Keycloak) ResolveUserEmail(ctx context.Context, user string) (string, b
 
 // Check if an email exists as primary user email
 func (k *Keycloak) EmailExists(ctx context.Context, email string) (bool, error) {
-	key := "email_exists:" + strings.ToLower(email)
+	email = normalizeEmail(email)
+	key := "email_exists:" + email
 	if _, ok, hit := k.cache.Get(key); hit {
 		return ok, nil
 	}
@@ -158,27 +166,196 @@ func (k *Keycloak) EmailExists(ctx context.Context, email string) (bool, error)
 	if err != nil {
 		return false, err
 	}
+	for _, form := range idpEmailForms(email) {
+		q := url.Values{}
+		q.Set("email", form)
+		q.Set("exact", "true")
+		users, err := k.adminGet(ctx, bearer, "/users", q)
+		if err != nil {
+			log.Printf("keycloak admin exact email lookup failed for %s: %v", form, err)
+			// fallback: search
+			q2 := url.Values{}
+			q2.Set("search", form)
+			users, err = k.adminGet(ctx, bearer, "/users", q2)
+			if err != nil {
+				log.Printf("keycloak admin search email lookup failed for %s: %v", form, err)
+				return false, err
+			}
+		}
+		for _, u := range users {
+			if u.Enabled && normalizeEmail(u.Email) == email {
+				k.cache.Put(key, "", true)
+				return true, nil
+			}
+		}
+	}
+	k.cache.Put(key, "", false)
+	return false, nil
+}
+
+type kcGroup struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// Find the groups an enabled user (username) is a direct member of
+func (k *Keycloak) UserGroups(ctx context.Context, user string) ([]string, error) {
+	key := "groups_by_user:" + strings.ToLower(user)
+	if groups, _, hit := k.cache.Get(key); hit {
+		return splitCacheList(groups), nil
+	}
+
+	bearer, err := k.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	q := url.Values{}
-	q.Set("email", email)
+	q.Set("username", user)
 	q.Set("exact", "true")
 	users, err := k.adminGet(ctx, bearer, "/users", q)
 	if err != nil {
-		log.Printf("keycloak admin exact email lookup failed for %s: %v", email, err)
-		// fallback: search
-		q2 := url.Values{}
-		q2.Set("search", email)
-		users, err = k.adminGet(ctx, bearer, "/users", q2)
-		if err != nil {
-			log.Printf("keycloak admin search email lookup failed for %s: %v", email, err)
+		log.Printf("keycloak admin exact username lookup failed for %s: %v", user, err)
+		return nil, err
+	}
+
+	var names []string
+	for _, u := range users {
+		if !strings.EqualFold(u.Username, user) || !u.Enabled || u.ID == "" {
+			continue
+		}
+		var groups []kcGroup
+		if err := k.adminGetJSON(ctx, bearer, "/users/"+url.PathEscape(u.ID)+"/groups", nil, &groups); err != nil {
+			log.Printf("keycloak admin groups lookup failed for %s: %v", user, err)
+			return nil, err
+		}
+		for _, g := range groups {
+			names = append(names, g.Name)
+		}
+		break
+	}
+	k.cache.Put(key, joinCacheList(names), len(names) > 0)
+	return names, nil
+}
+
+type kcRole struct {
+	Name string `json:"name"`
+}
+
+type kcClient struct {
+	ID       string `json:"id"`
+	ClientID string `json:"clientId"`
+}
+
+// Reports whether an enabled user (username) holds the required role,
+// directly or through a composite role or group. Everyone may send when no
+// role is required.
+func (k *Keycloak) UserMaySend(ctx context.Context, user string) (bool, error) {
+	if k.cfg.RequiredRole == "" {
+		return true, nil
+	}
+	key := "may_send:" + strings.ToLower(user)
+	if _, ok, hit := k.cache.Get(key); hit {
+		return ok, nil
+	}
+
+	bearer, err := k.token(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	q := url.Values{}
+	q.Set("username", user)
+	q.Set("exact", "true")
+	users, err := k.adminGet(ctx, bearer, "/users", q)
+	if err != nil {
+		log.Printf("keycloak admin exact username lookup failed for %s: %v", user, err)
+		return false, err
+	}
+
+	allowed := false
+	for _, u := range users {
+		if !strings.EqualFold(u.Username, user) || !u.Enabled || u.ID == "" {
+			continue
+		}
+		path := "/users/" + url.PathEscape(u.ID) + "/role-mappings/realm/composite"
+		if k.cfg.RequiredRoleClient != "" {
+			clientID, err := k.clientUUID(ctx, bearer, k.cfg.RequiredRoleClient)
+			if err != nil {
+				return false, err
+			}
+			path = "/users/" + url.PathEscape(u.ID) + "/role-mappings/clients/" + url.PathEscape(clientID) + "/composite"
+		}
+		var roles []kcRole
+		if err := k.adminGetJSON(ctx, bearer, path, nil, &roles); err != nil {
+			log.Printf("keycloak admin role mappings lookup failed for %s: %v", user, err)
 			return false, err
 		}
+		for _, r := range roles {
+			if r.Name == k.cfg.RequiredRole {
+				allowed = true
+				break
+			}
+		}
+		break
+	}
+	k.cache.Put(key, "", allowed)
+	return allowed, nil
+}
+
+// Find the internal id of a client from its clientId
+func (k *Keycloak) clientUUID(ctx context.Context, bearer, clientID string) (string, error) {
+	key := "client_uuid:" + clientID
+	if id, ok, hit := k.cache.Get(key); hit && ok {
+		return id, nil
 	}
+	q := url.Values{}
+	q.Set("clientId", clientID)
+	var clients []kcClient
+	if err := k.adminGetJSON(ctx, bearer, "/clients", q, &clients); err != nil {
+		log.Printf("keycloak admin client lookup failed for %s: %v", clientID, err)
+		return "", err
+	}
+	for _, c := range clients {
+		if c.ClientID == clientID && c.ID != "" {
+			k.cache.Put(key, c.ID, true)
+			return c.ID, nil
+		}
+	}
+	return "", fmt.Errorf("keycloak client %q not found", clientID)
+}
+
+// Find the first value of an attribute of an enabled user (username)
+func (k *Keycloak) UserAttribute(ctx context.Context, user, name string) (string, bool, error) {
+	key := "attr:" + name + ":" + strings.ToLower(user)
+	if val, ok, hit := k.cache.Get(key); hit {
+		return val, ok, nil
+	}
+
+	bearer, err := k.token(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	q := url.Values{}
+	q.Set("username", user)
+	q.Set("exact", "true")
+	users, err := k.adminGet(ctx, bearer, "/users", q)
+	if err != nil {
+		log.Printf("keycloak admin exact username lookup failed for %s: %v", user, err)
+		return "", false, err
+	}
+
 	for _, u := range users {
-		if u.Enabled && strings.EqualFold(u.Email, email) {
-			k.cache.Put(key, "", true)
-			return true, nil
+		if strings.EqualFold(u.Username, user) && u.Enabled {
+			if vals := u.Attrs[name]; len(vals) > 0 {
+				k.cache.Put(key, vals[0], true)
+				return vals[0], true, nil
+			}
+			break
 		}
 	}
 	k.cache.Put(key, "", false)
-	return false, nil
+	return "", false, nil
 }
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func newTestKeycloak(t *testing.T, handler http.HandlerFunc) (*Keycloak, *httptest.Server) {
@@ -248,3 +249,155 @@ func TestKeycloakAdminQueryEncoding(t *testing.T) {
 		t.Fatalf("unexpected query: %v", gotQuery)
 	}
 }
+
+func TestKeycloakUserGroups(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/realms/realm/protocol/openid-connect/token":
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"access_token": "token",
+				"expires_in":   300,
+			})
+		case "/admin/realms/realm/users":
+			_ = json.NewEncoder(w).Encode([]map[string]any{{
+				"id":       "u-1",
+				"username": "bob",
+				"enabled":  true,
+			}})
+		case "/admin/realms/realm/users/u-1/groups":
+			_ = json.NewEncoder(w).Encode([]map[string]any{
+				{"id": "g-1", "name": "staff", "path": "/staff"},
+				{"id": "g-2", "name": "mail-admins", "path": "/staff/mail-admins"},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	kc, srv := newTestKeycloak(t, handler)
+	defer srv.Close()
+
+	groups, err := kc.UserGroups(context.Background(), "bob")
+	if err != nil {
+		t.Fatalf("UserGroups error: %v", err)
+	}
+	if len(groups) != 2 || groups[0] != "staff" || groups[1] != "mail-admins" {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+
+	groups, err = kc.UserGroups(context.Background(), "carol")
+	if err != nil {
+		t.Fatalf("UserGroups error: %v", err)
+	}
+	if len(groups) != 0 {
+		t.Fatalf("expected no groups for unknown user, got %v", groups)
+	}
+}
+
+func TestKeycloakUserMaySend(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/realms/realm/protocol/openid-connect/token":
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"access_token": "token",
+				"expires_in":   300,
+			})
+		case "/admin/realms/realm/users":
+			users := map[string]string{"bob": "u-1", "carol": "u-2"}
+			name := r.URL.Query().Get("username")
+			if id, ok := users[name]; ok {
+				_ = json.NewEncoder(w).Encode([]map[string]any{{"id": id, "username": name, "enabled": true}})
+				return
+			}
+			_ = json.NewEncoder(w).Encode([]map[string]any{})
+		case "/admin/realms/realm/users/u-1/role-mappings/realm/composite":
+			_ = json.NewEncoder(w).Encode([]map[string]any{{"name": "offline_access"}, {"name": "mail-users"}})
+		case "/admin/realms/realm/users/u-2/role-mappings/realm/composite":
+			_ = json.NewEncoder(w).Encode([]map[string]any{{"name": "offline_access"}})
+		case "/admin/realms/realm/clients":
+			if r.URL.Query().Get("clientId") != "mail" {
+				_ = json.NewEncoder(w).Encode([]map[string]any{})
+				return
+			}
+			_ = json.NewEncoder(w).Encode([]map[string]any{{"id": "c-1", "clientId": "mail"}})
+		case "/admin/realms/realm/users/u-1/role-mappings/clients/c-1/composite":
+			_ = json.NewEncoder(w).Encode([]map[string]any{})
+		case "/admin/realms/realm/users/u-2/role-mappings/clients/c-1/composite":
+			_ = json.NewEncoder(w).Encode([]map[string]any{{"name": "mail-users"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	kc, srv := newTestKeycloak(t, handler)
+	defer srv.Close()
+	ctx := context.Background()
+
+	if ok, err := kc.UserMaySend(ctx, "carol"); err != nil || !ok {
+		t.Fatalf("expected everyone to send without required role, got %v %v", ok, err)
+	}
+
+	kc.cfg.RequiredRole = "mail-users"
+	for user, want := range map[string]bool{"bob": true, "carol": false, "dave": false} {
+		ok, err := kc.UserMaySend(ctx, user)
+		if err != nil {
+			t.Fatalf("UserMaySend(%s) error: %v", user, err)
+		}
+		if ok != want {
+			t.Fatalf("UserMaySend(%s) = %v, want %v", user, ok, want)
+		}
+	}
+
+	kc.cfg.RequiredRoleClient = "mail"
+	kc.cache = NewCache(time.Second)
+	for user, want := range map[string]bool{"bob": false, "carol": true} {
+		ok, err := kc.UserMaySend(ctx, user)
+		if err != nil {
+			t.Fatalf("UserMaySend(%s) error: %v", user, err)
+		}
+		if ok != want {
+			t.Fatalf("client role: UserMaySend(%s) = %v, want %v", user, ok, want)
+		}
+	}
+
+	kc.cfg.RequiredRoleClient = "missing"
+	kc.cache = NewCache(time.Second)
+	if _, err := kc.UserMaySend(ctx, "bob"); err == nil {
+		t.Fatalf("expected error for unknown client")
+	}
+}
+
+func TestKeycloakUserAttribute(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/realms/realm/protocol/openid-connect/token":
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"access_token": "token",
+				"expires_in":   300,
+			})
+		case "/admin/realms/realm/users":
+			_ = json.NewEncoder(w).Encode([]map[string]any{{
+				"id":         "u-1",
+				"username":   "bob",
+				"enabled":    true,
+				"attributes": map[string][]string{"mailMaxSize": {"1048576"}},
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	kc, srv := newTestKeycloak(t, handler)
+	defer srv.Close()
+
+	val, ok, err := kc.UserAttribute(context.Background(), "bob", "mailMaxSize")
+	if err != nil || !ok || val != "1048576" {
+		t.Fatalf("unexpected attribute: %q %v %v", val, ok, err)
+	}
+	if _, ok, err := kc.UserAttribute(context.Background(), "bob", "missing"); err != nil || ok {
+		t.Fatalf("expected missing attribute, got %v %v", ok, err)
+	}
+}
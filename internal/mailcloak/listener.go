@@ -1,12 +1,14 @@
 package mailcloak
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -21,6 +23,24 @@ type temporaryError interface {
 	Temporary() bool
 }
 
+// Connection counters for a listener
+type ConnStats struct {
+	Accepted atomic.Uint64
+	Active   atomic.Int64
+	Refused  atomic.Uint64
+	TimedOut atomic.Uint64
+}
+
+func (s *ConnStats) String() string {
+	return fmt.Sprintf("accepted=%d active=%d refused=%d timed_out=%d",
+		s.Accepted.Load(), s.Active.Load(), s.Refused.Load(), s.TimedOut.Load())
+}
+
+var (
+	PolicyConnStats    ConnStats
+	SocketmapConnStats ConnStats
+)
+
 func prepareUnixSocket(path string) error {
 	info, err := os.Lstat(path)
 	if err != nil {
@@ -53,9 +73,16 @@ func isStaleUnixSocketDialErr(err error) bool {
 	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT)
 }
 
-func serveListener(ctx context.Context, serverName string, l net.Listener, handle func(net.Conn)) error {
+func serveListener(ctx context.Context, serverName string, l net.Listener, srv ServerConfig, stats *ConnStats, handle func(net.Conn)) error {
 	var retryDelay time.Duration
 
+	// Bounded set of connection slots; while it is full, an accepted
+	// connection waits up to the queue timeout for a slot and is then closed.
+	var slots chan struct{}
+	if srv.MaxConnections > 0 {
+		slots = make(chan struct{}, srv.MaxConnections)
+	}
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -85,8 +112,79 @@ func serveListener(ctx context.Context, serverName string, l net.Listener, handl
 		}
 
 		retryDelay = 0
-		handle(conn)
+		stats.Accepted.Add(1)
+
+		if !acquireConnSlot(ctx, slots, srv.queueTimeout()) {
+			stats.Refused.Add(1)
+			log.Printf("%s connection refused: %d concurrent connections limit reached", serverName, srv.MaxConnections)
+			_ = conn.Close()
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+		}
+
+		stats.Active.Add(1)
+		go func() {
+			defer func() {
+				stats.Active.Add(-1)
+				if slots != nil {
+					<-slots
+				}
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// Waits up to timeout for a free connection slot. A nil slots channel means unlimited.
+func acquireConnSlot(ctx context.Context, slots chan struct{}, timeout time.Duration) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if timeout <= 0 {
+		return false
 	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+// Returns the deadline for a timeout, or the zero time (no deadline) if disabled
+func deadlineAfter(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// Applies the idle timeout while waiting for the next request on conn, then
+// the read timeout once its first byte has arrived.
+func waitForRequest(conn net.Conn, r *bufio.Reader, srv ServerConfig) error {
+	_ = conn.SetReadDeadline(deadlineAfter(srv.idleTimeout()))
+	if _, err := r.Peek(1); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(deadlineAfter(srv.readTimeout()))
+	return nil
+}
+
+func isTimeoutErr(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
 func nextAcceptRetryDelay(current time.Duration) time.Duration {
@@ -0,0 +1,112 @@
+package mailcloak
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Would-be rejections per reason while in monitor mode
+type MonitorStats struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+var PolicyMonitorStats MonitorStats
+
+func (s *MonitorStats) Add(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts == nil {
+		s.counts = make(map[string]uint64)
+	}
+	s.counts[reason]++
+}
+
+func (s *MonitorStats) Count(reason string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[reason]
+}
+
+func (s *MonitorStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.counts) == 0 {
+		return "none"
+	}
+	reasons := make([]string, 0, len(s.counts))
+	for reason := range s.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	parts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		parts = append(parts, fmt.Sprintf("%q=%d", reason, s.counts[reason]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Reasons about the recipient; any other decision is about the sender
+var recipientReasons = map[string]bool{
+	reasonNoSuchUser:  true,
+	reasonRelayDenied: true,
+	reasonGreylisted:  true,
+}
+
+// The mode applying to a decision: the override of the domain its reason is
+// about (the recipient domain for recipient reasons, the sender domain
+// otherwise), then the other domain's, then the global policy.mode. A mode
+// set in the domains table wins over policy.domain_modes.
+func policyMode(cfg *Config, req *policyRequest) string {
+	type domain struct {
+		addr     string
+		settings DomainSettings
+	}
+	domains := []domain{{req.Sender, req.SenderDomain}, {req.Recipient, req.RecipientDomain}}
+	if recipientReasons[req.Reason] {
+		domains[0], domains[1] = domains[1], domains[0]
+	}
+	for _, d := range domains {
+		if d.settings.Mode == "enforce" || d.settings.Mode == "monitor" {
+			return d.settings.Mode
+		}
+		if name, ok := domainFromEmail(d.addr); ok {
+			if mode, ok := cfg.Policy.DomainModes[name]; ok {
+				return mode
+			}
+		}
+	}
+	return cfg.Policy.Mode
+}
+
+// DUNNO and PREPEND let the message through, anything else is enforced
+func isEnforcingAction(action string) bool {
+	return action != "DUNNO" && !strings.HasPrefix(action, "PREPEND ")
+}
+
+// In monitor mode, log what would have been done and let the request through.
+// A monitored sender rejection is evaluated again at every RCPT of the
+// message, so each reason is counted once per message.
+func (s *policySession) applyPolicyMode(cfg *Config, req *policyRequest, action string) string {
+	if !isEnforcingAction(action) || policyMode(cfg, req) != "monitor" {
+		return action
+	}
+	reason := req.Reason
+	if reason == "" {
+		reason = "unknown"
+	}
+	if req.Instance != s.monitoredFor {
+		s.monitoredFor, s.monitored = req.Instance, nil
+	}
+	if req.Instance == "" || !slices.Contains(s.monitored, reason) {
+		s.monitored = append(s.monitored, reason)
+		PolicyMonitorStats.Add(reason)
+	}
+	log.Printf("policy monitor: state=%s would_action=%q reason=%s sasl=%s sender=%s rcpt=%s client=%s",
+		req.State, action, reason, req.SASLUser, req.Sender, req.Recipient, req.ClientAddress)
+	return "DUNNO"
+}
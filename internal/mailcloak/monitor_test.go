@@ -0,0 +1,143 @@
+package mailcloak
+
+import (
+	"testing"
+
+	"mailcloak/internal/mailcloak/testutil"
+)
+
+func TestPolicyMonitorMode(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertDomain(t, sqlDB, "strict.com", true)
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser:    map[string]string{"alice": "alice@example.com"},
+		EmailExistsSet: map[string]bool{"alice@example.com": true},
+	}
+
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.Mode = "monitor"
+	cfg.Policy.DomainModes = map[string]string{"strict.com": "enforce"}
+
+	relay := &policyRequest{State: "RCPT", Sender: "user@other.com", Recipient: "a@other.com"}
+	before := PolicyMonitorStats.Count(reasonRelayDenied)
+	sess := &policySession{}
+	if got := sess.decide(cfg, db, fakeIDP, relay); got != "DUNNO" {
+		t.Fatalf("expected DUNNO in monitor mode, got %q", got)
+	}
+	if got := PolicyMonitorStats.Count(reasonRelayDenied); got != before+1 {
+		t.Fatalf("expected would-be rejection to be counted, got %d (was %d)", got, before)
+	}
+
+	// strict.com overrides the global monitor mode
+	unknown := &policyRequest{State: "RCPT", Sender: "user@other.com", Recipient: "nobody@strict.com"}
+	if got := sess.decide(cfg, db, fakeIDP, unknown); got != "550 5.1.1 No such user" {
+		t.Fatalf("expected enforced rejection for strict.com, got %q", got)
+	}
+
+	// monitor a single domain while enforcing everywhere else
+	cfg.Policy.Mode = "enforce"
+	cfg.Policy.DomainModes = map[string]string{"example.com": "monitor"}
+	spoof := &policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "bob@example.com", Recipient: "a@other.com"}
+	if got := sess.decide(cfg, db, fakeIDP, spoof); got != "DUNNO" {
+		t.Fatalf("expected DUNNO for monitored sender domain, got %q", got)
+	}
+	if got := sess.decide(cfg, db, fakeIDP, relay); got != "550 5.7.1 Recipient domain not local" {
+		t.Fatalf("expected enforced rejection outside monitored domain, got %q", got)
+	}
+}
+
+func TestPolicyModePerReason(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "strict.com", true)
+	testutil.InsertDomain(t, sqlDB, "trial.com", true)
+	testutil.SetDomainSetting(t, sqlDB, "strict.com", "policy_mode", "enforce")
+	testutil.SetDomainSetting(t, sqlDB, "trial.com", "policy_mode", "monitor")
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser:    map[string]string{"alice": "alice@trial.com"},
+		EmailExistsSet: map[string]bool{"bob@trial.com": true},
+	}
+	cfg := testPolicyConfig("tempfail")
+
+	cases := []struct {
+		name   string
+		req    policyRequest
+		expect string
+	}{
+		{
+			name:   "spoofed sender of enforcing domain to monitored recipient domain",
+			req:    policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "ceo@strict.com", Recipient: "bob@trial.com"},
+			expect: "553 5.7.1 Sender not owned by authenticated user",
+		},
+		{
+			name:   "unknown recipient of monitored domain",
+			req:    policyRequest{State: "RCPT", Sender: "x@remote.net", Recipient: "nobody@trial.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "unknown recipient of enforcing domain from monitored sender domain",
+			req:    policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice@trial.com", Recipient: "nobody@strict.com"},
+			expect: "550 5.1.1 No such user",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sess := &policySession{}
+			req := tc.req
+			if got := sess.decide(cfg, db, fakeIDP, &req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestPolicyMonitorCountsOncePerMessage(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser: map[string]string{"alice": "alice@example.com"},
+	}
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.Mode = "monitor"
+
+	before := PolicyMonitorStats.Count(reasonSenderNotOwned)
+	sess := &policySession{}
+	for _, r := range []*policyRequest{
+		{State: "MAIL", Instance: "1", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "bob@example.com"},
+		{State: "RCPT", Instance: "1", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "bob@example.com", Recipient: "a@other.com"},
+		{State: "RCPT", Instance: "1", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "bob@example.com", Recipient: "b@other.com"},
+		{State: "RCPT", Instance: "2", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "bob@example.com", Recipient: "a@other.com"},
+	} {
+		if got := sess.decide(cfg, db, fakeIDP, r); got != "DUNNO" {
+			t.Fatalf("expected DUNNO in monitor mode, got %q", got)
+		}
+	}
+	if got := PolicyMonitorStats.Count(reasonSenderNotOwned); got != before+2 {
+		t.Fatalf("expected 2 would-be rejections, got %d", got-before)
+	}
+}
+
+func TestIsEnforcingAction(t *testing.T) {
+	for _, action := range []string{"553 5.7.1 Sender not owned by authenticated user", "HOLD held by policy rule review"} {
+		if !isEnforcingAction(action) {
+			t.Fatalf("expected %q to be enforcing", action)
+		}
+	}
+	for _, action := range []string{"DUNNO", "PREPEND X-Foo: bar"} {
+		if isEnforcingAction(action) {
+			t.Fatalf("expected %q not to be enforcing", action)
+		}
+	}
+}
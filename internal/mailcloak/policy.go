@@ -3,9 +3,15 @@ package mailcloak
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,6 +21,17 @@ type IdentityResolver interface {
 	EmailExists(ctx context.Context, email string) (bool, error)
 }
 
+// Optionally implemented by identity providers exposing group membership
+type GroupResolver interface {
+	UserGroups(ctx context.Context, user string) ([]string, error)
+}
+
+// Optionally implemented by identity providers restricting submission to
+// users holding a configured role or group
+type SendPermissionResolver interface {
+	UserMaySend(ctx context.Context, user string) (bool, error)
+}
+
 func OpenPolicyListener(cfg *Config) (net.Listener, error) {
 	sock := cfg.Sockets.PolicySocket
 	if err := prepareUnixSocket(sock); err != nil {
@@ -36,8 +53,8 @@ func OpenPolicyListener(cfg *Config) (net.Listener, error) {
 }
 
 func ServePolicy(ctx context.Context, cfg *Config, db *MailcloakDB, idp IdentityResolver, l net.Listener) error {
-	return serveListener(ctx, "policy", l, func(conn net.Conn) {
-		go handlePolicyConn(conn, cfg, db, idp)
+	return serveListener(ctx, "policy", l, cfg.Server, &PolicyConnStats, func(conn net.Conn) {
+		handlePolicyConn(conn, cfg, db, idp)
 	})
 }
 
@@ -52,156 +69,767 @@ func RunPolicy(ctx context.Context, cfg *Config, db *MailcloakDB, idp IdentityRe
 func handlePolicyConn(conn net.Conn, cfg *Config, db *MailcloakDB, idp IdentityResolver) {
 	defer conn.Close()
 	r := bufio.NewReader(conn)
+	sess := &policySession{}
 
+	// Postfix keeps policy connections open and sends several requests
+	// over them, so serve requests until EOF or the client goes idle.
+	for {
+		err := waitForRequest(conn, r, cfg.Server)
+		var req map[string]string
+		if err == nil {
+			req, err = readPolicyRequest(r)
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, io.EOF):
+				// normal close
+			case isTimeoutErr(err):
+				PolicyConnStats.TimedOut.Add(1)
+				log.Printf("policy connection timeout: %v", err)
+			default:
+				log.Printf("policy read error: %v", err)
+			}
+			return
+		}
+
+		action := handlePolicyRequest(cfg, db, idp, sess, req)
+		_ = conn.SetWriteDeadline(deadlineAfter(cfg.Server.writeTimeout()))
+		if _, err := fmt.Fprintf(conn, "action=%s\n\n", action); err != nil {
+			if isTimeoutErr(err) {
+				PolicyConnStats.TimedOut.Add(1)
+			}
+			log.Printf("policy write error: %v", err)
+			return
+		}
+	}
+}
+
+// Postfix policy framing: "name=value" lines terminated by an empty line
+func readPolicyRequest(r *bufio.Reader) (map[string]string, error) {
 	req := map[string]string{}
+	started := false
 	for {
 		line, err := r.ReadString('\n')
 		if err != nil {
-			return
+			if (started || line != "") && errors.Is(err, io.EOF) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
 		}
+		started = true
 		line = strings.TrimRight(line, "\r\n")
 		if line == "" {
-			break
+			return req, nil
 		}
 		if i := strings.IndexByte(line, '='); i > 0 {
 			req[line[:i]] = line[i+1:]
 		}
 	}
+}
+
+type policyRequest struct {
+	State          string // protocol_state, e.g. MAIL, RCPT
+	Instance       string // identifies the message transaction
+	QueueID        string
+	SASLMethod     string
+	SASLUser       string
+	Sender         string
+	Recipient      string
+	ClientAddress  string
+	RecipientCount int   // only set from DATA onwards
+	Size           int64 // declared at MAIL, actual at END-OF-MESSAGE
+
+	Reason string // named reason of the reply, set while deciding
+
+	// TLS client certificate, sent when smtpd_tls_ask_ccert is enabled
+	CertFingerprint       string
+	CertPubkeyFingerprint string
+	CertSubject           string
+
+	// Settings of the recipient and sender domains, if local
+	RecipientDomain DomainSettings
+	SenderDomain    DomainSettings
+}
+
+func newPolicyRequest(attrs map[string]string) *policyRequest {
+	recipientCount, _ := strconv.Atoi(attrs["recipient_count"])
+	size, _ := strconv.ParseInt(attrs["size"], 10, 64)
+	return &policyRequest{
+		State:          strings.ToUpper(attrs["protocol_state"]),
+		Instance:       attrs["instance"],
+		QueueID:        attrs["queue_id"],
+		SASLMethod:     strings.ToLower(attrs["sasl_method"]),
+		SASLUser:       attrs["sasl_username"],
+		Sender:         normalizeEmail(attrs["sender"]),
+		Recipient:      normalizeEmail(attrs["recipient"]),
+		ClientAddress:  attrs["client_address"],
+		RecipientCount: recipientCount,
+		Size:           size,
+
+		CertFingerprint:       attrs["ccert_fingerprint"],
+		CertPubkeyFingerprint: attrs["ccert_pubkey_fingerprint"],
+		CertSubject:           attrs["ccert_subject"],
+	}
+}
 
-	log.Printf("policy request: state=%s sasl=%s sender=%s rcpt=%s client=%s helo=%s", req["protocol_state"], req["sasl_username"], req["sender"], req["recipient"], req["client_address"], req["helo_name"])
+func isUserAuth(saslMethod string) bool {
+	return saslMethod == "xoauth2" || saslMethod == "oauthbearer"
+}
 
-	// Decide based on protocol_state
-	state := req["protocol_state"] // e.g. RCPT, MAIL
-	saslMethod := strings.ToLower(req["sasl_method"])
-	saslUser := req["sasl_username"]
-	sender := strings.ToLower(req["sender"])
-	rcpt := strings.ToLower(req["recipient"])
+func isAppAuth(saslMethod string) bool {
+	return saslMethod == "plain" || saslMethod == "login" || saslMethod == certMethod
+}
+
+// State kept across the requests of one policy connection. Postfix serves
+// one SMTP session at a time over a connection, so this tracks the
+// current message transaction.
+type policySession struct {
+	senderOK string // key of the last sender check that passed
+	heldNoID string // instance held without a queue id yet
+
+	// Reasons already counted as would-be rejections of monitoredFor
+	monitoredFor string
+	monitored    []string
+
+	// Headers of the message transaction headersFor: already prepended,
+	// and waiting for an accepted request to be prepended with
+	headersFor string
+	prepended  []string
+	pending    []string
+}
+
+// Identifies a sender check; empty if the request has no transaction id
+func senderCheckKey(req *policyRequest) string {
+	if req.Instance == "" {
+		return ""
+	}
+	return req.Instance + "\x00" + req.SASLMethod + "\x00" + req.SASLUser + "\x00" + req.Sender
+}
+
+func handlePolicyRequest(cfg *Config, db *MailcloakDB, idp IdentityResolver, sess *policySession, attrs map[string]string) string {
+	log.Printf("policy request: state=%s sasl=%s sender=%s rcpt=%s client=%s helo=%s", attrs["protocol_state"], attrs["sasl_username"], attrs["sender"], attrs["recipient"], attrs["client_address"], attrs["helo_name"])
+
+	req := newPolicyRequest(attrs)
+	action := sess.decide(cfg, db, idp, req)
+
+	log.Printf("policy decision: state=%s action=%s reason=%s sasl=%s sender=%s rcpt=%s", req.State, action, req.Reason, req.SASLUser, req.Sender, req.Recipient)
+
+	return action
+}
+
+// Evaluate the request, then apply policy.mode (enforce or monitor)
+func (s *policySession) decide(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest) string {
+	action := s.applyPolicyMode(cfg, req, s.evaluate(cfg, db, idp, req))
+	if s.heldNoID != "" && s.heldNoID == req.Instance && req.QueueID != "" {
+		setHeldQueueID(db, req)
+		s.heldNoID = ""
+	}
+	if strings.HasPrefix(action, "HOLD") || strings.HasPrefix(action, "FILTER ") {
+		recordHeldMessage(db, req, action)
+		if req.QueueID == "" {
+			s.heldNoID = req.Instance
+		}
+	}
+	return action
+}
+
+// Configured rules run first, then the built-in checks unless a rule
+// accepted the request or policy.rules_mode is "instead". Apps identified
+// by a client certificate are mapped before either.
+func (s *policySession) evaluate(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest) string {
+	if action := certIdentity(cfg, db, req); action != "DUNNO" {
+		return action
+	}
+	if action := loadDomainSettings(cfg, db, req); action != "DUNNO" {
+		return action
+	}
+
+	rules := evaluateRules(cfg, idp, req)
+	if rules.action != "" {
+		return rules.action
+	}
 
 	action := "DUNNO"
+	var headers []string
+	if !rules.accepted && cfg.Policy.RulesMode != "instead" {
+		action = s.builtin(cfg, db, idp, req)
+		if action == "DUNNO" && req.State == "RCPT" && req.Recipient != "" {
+			headers = append(headers, identityHeader(cfg, req))
+		}
+	}
+	if action != "DUNNO" {
+		return action
+	}
+	if header := s.nextPrepend(req, append(headers, rules.prepend)...); header != "" {
+		return "PREPEND " + header
+	}
+	return "DUNNO"
+}
+
+// Each header is prepended once per message, although RCPT runs once per
+// recipient and rules may match at every stage. A reply carries a single
+// PREPEND, so further headers wait for the next accepted request of the
+// message, e.g. the next recipient or DATA. END-OF-MESSAGE cannot prepend.
+func (s *policySession) nextPrepend(req *policyRequest, headers ...string) string {
+	if req.State == "END-OF-MESSAGE" {
+		return ""
+	}
+	if req.Instance == "" {
+		// No transaction id to remember the headers by
+		for _, h := range headers {
+			if h != "" {
+				return h
+			}
+		}
+		return ""
+	}
+	if req.Instance != s.headersFor {
+		s.headersFor, s.prepended, s.pending = req.Instance, nil, nil
+	}
+	for _, h := range headers {
+		if h != "" && !slices.Contains(s.prepended, h) && !slices.Contains(s.pending, h) {
+			s.pending = append(s.pending, h)
+		}
+	}
+	if len(s.pending) == 0 {
+		return ""
+	}
+	header := s.pending[0]
+	s.pending = s.pending[1:]
+	s.prepended = append(s.prepended, header)
+	return header
+}
+
+// Decide based on protocol_state. With "smtpd_delay_reject = yes" (the
+// Postfix default) the MAIL stage is not queried separately, so RCPT runs
+// the sender checks too unless they already passed at MAIL.
+func (s *policySession) builtin(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest) string {
+	switch req.State {
+	case "MAIL":
+		action := senderPolicy(cfg, db, idp, req)
+		if action == "DUNNO" {
+			s.senderOK = senderCheckKey(req)
+			// Size declared with the SIZE extension, if any
+			action = sizePolicy(cfg, db, idp, req)
+		}
+		return action
 
-	switch state {
 	case "RCPT":
-		action = policy(cfg, db, idp, sender, rcpt, saslMethod, saslUser)
+		if req.Recipient == "" {
+			return "DUNNO"
+		}
+		var action string
+		if key := senderCheckKey(req); key != "" && key == s.senderOK {
+			action = recipientPolicy(cfg, db, idp, req)
+		} else {
+			action = policy(cfg, db, idp, req)
+			if action == "DUNNO" {
+				s.senderOK = senderCheckKey(req)
+			}
+		}
+		if action != "DUNNO" {
+			return action
+		}
+		if action = greylistPolicy(cfg, db, req, time.Now()); action != "DUNNO" {
+			return action
+		}
+		// The identity header is prepended by evaluate
+		return ratePolicy(cfg, db, req)
 
-	// With "smtpd_delay_reject = yes" in Postfix, MAIL stage is bypassed
-	// So we move all checks to RCPT stage
+	case "END-OF-MESSAGE":
+		action := messagePolicy(cfg, db, idp, req)
+		if action == "DUNNO" && cfg.Policy.RecordMessages {
+			recordMessage(db, req)
+		}
+		return action
 
 	default:
-		action = "DUNNO"
+		return "DUNNO"
+	}
+}
+
+// Returns the header identifying an authenticated submitter, if configured.
+// PREPEND does not change the decision: Postfix goes on as with DUNNO.
+func identityHeader(cfg *Config, req *policyRequest) string {
+	ph := cfg.Policy.PrependHeaders
+	if !ph.Enabled || req.SASLUser == "" {
+		return ""
 	}
 
-	log.Printf("policy decision: state=%s action=%s sasl=%s sender=%s rcpt=%s", state, action, saslUser, sender, rcpt)
+	var name string
+	switch {
+	case isUserAuth(req.SASLMethod):
+		name = ph.UserHeader
+	case isAppAuth(req.SASLMethod):
+		name = ph.AppHeader
+	default:
+		return ""
+	}
+
+	value := sanitizeHeaderValue(req.SASLUser)
+	if ph.IncludeAuthMethod {
+		value += "; auth=" + req.SASLMethod
+	}
+	return name + ": " + value
+}
 
-	fmt.Fprintf(conn, "action=%s\n\n", action)
+// Keeps header values on one line of printable characters
+func sanitizeHeaderValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, v)
 }
 
-func policy(cfg *Config, db *MailcloakDB, idp IdentityResolver, sender, rcpt, saslMethod, saslUser string) string {
-	if rcpt == "" {
+// Per-message limits for authenticated submissions, the sender domain may
+// override the recipient limit
+func messagePolicy(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest) string {
+	var limits MessageLimits
+	switch {
+	case isUserAuth(req.SASLMethod):
+		limits = cfg.Policy.MessageLimits.Users
+	case isAppAuth(req.SASLMethod):
+		limits = cfg.Policy.MessageLimits.Apps
+	default:
 		return "DUNNO"
 	}
+	if n := req.SenderDomain.MaxRecipients; n.Valid {
+		limits.MaxRecipients = int(n.Int64)
+	}
+
+	if limits.MaxRecipients > 0 && req.RecipientCount > limits.MaxRecipients {
+		log.Printf("policy message limit: sasl=%s recipients=%d max=%d", req.SASLUser, req.RecipientCount, limits.MaxRecipients)
+		return reply(cfg, req, reasonTooManyRecipients)
+	}
+	return sizePolicy(cfg, db, idp, req)
+}
+
+// Records a quarantined message so that admins can review it; like
+// accounting, failures are only logged
+func recordHeldMessage(db *MailcloakDB, req *policyRequest, action string) {
+	kind, _, _ := strings.Cut(action, " ")
+	err := db.RecordHeldMessage(HeldMessage{
+		QueueID:       req.QueueID,
+		Instance:      req.Instance,
+		Action:        strings.ToLower(kind),
+		Reason:        req.Reason,
+		SASLUser:      req.SASLUser,
+		Sender:        req.Sender,
+		Recipient:     req.Recipient,
+		ClientAddress: req.ClientAddress,
+	})
+	if err != nil {
+		log.Printf("sqlite held message log error: queue_id=%s err=%v", req.QueueID, err)
+	}
+}
+
+// Completes the records of a message held at RCPT, once DATA or
+// END-OF-MESSAGE carries its queue id
+func setHeldQueueID(db *MailcloakDB, req *policyRequest) {
+	if err := db.SetHeldQueueID(req.Instance, req.QueueID); err != nil {
+		log.Printf("sqlite held message log error: instance=%s queue_id=%s err=%v", req.Instance, req.QueueID, err)
+	}
+}
+
+// Accounting must never block mail, so failures are only logged
+func recordMessage(db *MailcloakDB, req *policyRequest) {
+	err := db.RecordMessage(MessageRecord{
+		QueueID:        req.QueueID,
+		SASLMethod:     req.SASLMethod,
+		SASLUser:       req.SASLUser,
+		Sender:         req.Sender,
+		ClientAddress:  req.ClientAddress,
+		RecipientCount: req.RecipientCount,
+		Size:           req.Size,
+	})
+	if err != nil {
+		log.Printf("sqlite message log error: queue_id=%s err=%v", req.QueueID, err)
+	}
+}
+
+// Full RCPT stage evaluation: recipient checks, then sender checks
+func policy(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest) string {
+	if req.Recipient == "" {
+		return "DUNNO"
+	}
+	if action := recipientPolicy(cfg, db, idp, req); action != "DUNNO" {
+		return action
+	}
+	return senderPolicy(cfg, db, idp, req)
+}
+
+func recipientPolicy(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest) string {
+	rcpt := req.Recipient
 
 	// Check recipient against local domains
 	rcptLocal, err := db.DomainFromEmailIsLocal(rcpt)
 	if err != nil {
 		log.Printf("sqlite domain lookup error: %v", err)
-		return "451 4.3.0 Temporary internal error"
+		return reply(cfg, req, reasonInternalError)
+	}
+	if !rcptLocal {
+		// Alias domain addresses are looked up in the domain they map onto
+		mapped, _, ok, err := db.ResolveAliasDomain(rcpt)
+		if err != nil {
+			log.Printf("sqlite alias domain lookup error: %v", err)
+			return reply(cfg, req, reasonInternalError)
+		}
+		if ok {
+			rcpt, rcptLocal = mapped, true
+		}
 	}
 	if rcptLocal {
-		// Check recipient exists
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		exists, err := idp.EmailExists(ctx, rcpt)
+		// Check recipient exists, as given or without its extension
+		found := false
+		for _, addr := range addressVariants(rcpt, cfg.Policy.RecipientDelimiter) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			exists, err := idp.EmailExists(ctx, addr)
+			cancel()
+			if err != nil {
+				log.Printf("idp email exists lookup error for %s: %v", addr, err)
+				if failOpen(cfg, req.RecipientDomain, req.SenderDomain) {
+					return "DUNNO"
+				}
+				return reply(cfg, req, reasonLookupFailure)
+			}
+			if !exists {
+				_, exists, err = db.AliasOwner(addr)
+				if err != nil {
+					log.Printf("sqlite alias sender lookup error: %v", err)
+					return reply(cfg, req, reasonInternalError)
+				}
+			}
+			if exists {
+				found = true
+				break
+			}
+		}
+		if !found {
+			// Unknown recipients go to the domain catch-all, if any
+			domain, _ := domainFromEmail(rcpt)
+			catchall, ok, err := db.DomainCatchall(domain)
+			if err != nil {
+				log.Printf("sqlite domain catch-all lookup error: %v", err)
+				return reply(cfg, req, reasonInternalError)
+			}
+			if !ok {
+				return reply(cfg, req, reasonNoSuchUser)
+			}
+			log.Printf("policy catch-all: rcpt=%s target=%s", rcpt, catchall)
+		}
+	}
+
+	if req.SASLMethod == "" {
+		// No authentication: block recipient to non-local domains
+		if !rcptLocal {
+			return reply(cfg, req, reasonRelayDenied)
+		}
+	}
+
+	// Authenticated users may send to any recipient unless internal-only,
+	// apps too unless they have a recipient allowlist
+	if isAppAuth(req.SASLMethod) {
+		return appRecipientPolicy(cfg, db, req)
+	}
+	if isUserAuth(req.SASLMethod) && !rcptLocal {
+		return internalOnlyPolicy(cfg, db, idp, req)
+	}
+	return "DUNNO"
+}
+
+// Rejects non-local recipients for users listed in internal_only_users or
+// members of policy.internal_only_group
+func internalOnlyPolicy(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest) string {
+	internal, err := db.UserInternalOnly(req.SASLUser)
+	if err != nil {
+		log.Printf("sqlite internal-only lookup error: %v", err)
+		return reply(cfg, req, reasonInternalError)
+	}
+	if !internal && cfg.Policy.InternalOnlyGroup != "" {
+		groups, err := userGroups(idp, req)
 		if err != nil {
-			log.Printf("idp email exists lookup error for %s: %v", rcpt, err)
-			if cfg.Policy.IDPFailureMode == "dunno" {
+			log.Printf("idp groups lookup error for %s: %v", req.SASLUser, err)
+			if failOpen(cfg, req.SenderDomain, req.RecipientDomain) {
 				return "DUNNO"
 			}
-			return "451 4.3.0 Temporary authentication/lookup failure"
+			return reply(cfg, req, reasonLookupFailure)
 		}
-		if !exists {
-			_, exists, err := db.AliasOwner(rcpt)
-			if err != nil {
-				log.Printf("sqlite alias sender lookup error: %v", err)
-				return "451 4.3.0 Temporary internal error"
+		for _, g := range groups {
+			if strings.EqualFold(g, cfg.Policy.InternalOnlyGroup) {
+				internal = true
+				break
 			}
-			if !exists {
-				return "550 5.1.1 No such user"
+		}
+	}
+	if !internal {
+		return "DUNNO"
+	}
+	log.Printf("policy internal-only user denied: sasl=%s rcpt=%s", req.SASLUser, req.Recipient)
+	return reply(cfg, req, reasonInternalOnly)
+}
+
+func appRecipientPolicy(cfg *Config, db *MailcloakDB, req *policyRequest) string {
+	patterns, err := db.AppRecipients(req.SASLUser)
+	if err != nil {
+		log.Printf("sqlite app recipients lookup error: %v", err)
+		return reply(cfg, req, reasonInternalError)
+	}
+	if len(patterns) == 0 {
+		return "DUNNO"
+	}
+	for _, addr := range addressVariants(req.Recipient, cfg.Policy.RecipientDelimiter) {
+		for _, p := range patterns {
+			if recipientMatches(p, addr) {
+				return "DUNNO"
 			}
 		}
 	}
+	log.Printf("policy app recipient denied: sasl=%s rcpt=%s", req.SASLUser, req.Recipient)
+	return reply(cfg, req, reasonAppRecipientDenied)
+}
 
-	if saslMethod == "" {
-		// No authentication:
-		// - Block recipient to non-local domains
-		// - Block sending from local domains
+// Patterns with an "@" match the whole address, others the domain. Both
+// may use shell wildcards, e.g. "*@ops.example.com" or "*.example.com".
+func recipientMatches(pattern, addr string) bool {
+	pattern = strings.ToLower(pattern)
+	if !strings.Contains(pattern, "@") {
+		domain, ok := domainFromEmail(addr)
+		if !ok {
+			return false
+		}
+		ok, _ = path.Match(pattern, domain)
+		return ok
+	}
+	ok, _ := path.Match(pattern, strings.ToLower(addr))
+	return ok
+}
 
-		if !rcptLocal {
-			return "550 5.7.1 Recipient domain not local"
+// Apps restricted to networks must connect from one of them
+func appNetworkPolicy(cfg *Config, db *MailcloakDB, req *policyRequest) string {
+	entries, err := db.AppNetworks(req.SASLUser)
+	if err != nil {
+		log.Printf("sqlite app networks lookup error: %v", err)
+		return reply(cfg, req, reasonInternalError)
+	}
+	if len(entries) == 0 {
+		return "DUNNO"
+	}
+
+	networks := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		n, err := parseNetwork(e)
+		if err != nil {
+			log.Printf("app %s: skipping %v", req.SASLUser, err)
+			continue
 		}
+		networks = append(networks, n)
+	}
+	if addrInNetworks(req.ClientAddress, networks) {
+		return "DUNNO"
+	}
+	log.Printf("policy app network denied: sasl=%s client=%s", req.SASLUser, req.ClientAddress)
+	return reply(cfg, req, reasonAppNetworkDenied)
+}
+
+// Null senders (MAIL FROM:<>) of authenticated users and apps are
+// rejected unless their policy.null_sender setting is "allow"
+func nullSenderPolicy(cfg *Config, req *policyRequest, setting string) string {
+	if setting == "allow" {
+		log.Printf("policy null sender: sasl_method=%s sasl=%s action=allow", req.SASLMethod, req.SASLUser)
+		return "DUNNO"
+	}
+	log.Printf("policy null sender: sasl_method=%s sasl=%s action=reject", req.SASLMethod, req.SASLUser)
+	return reply(cfg, req, reasonNullSender)
+}
+
+// The sender, plus the same address in the target domain when the sender
+// domain is an alias domain mapping senders. Like Postfix, an address is
+// also tried without its extension only when nothing owns it as given, so
+// that john-doe@ or sales-team@ do not fall back to john@ or sales@.
+func senderAddresses(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest) ([]string, string) {
+	candidates := []string{req.Sender}
+	mapped, senders, ok, err := db.ResolveAliasDomain(req.Sender)
+	if err != nil {
+		log.Printf("sqlite alias domain lookup error: %v", err)
+		return nil, reply(cfg, req, reasonInternalError)
+	}
+	if ok && senders {
+		candidates = append(candidates, mapped)
+	}
 
+	var addrs []string
+	for _, addr := range candidates {
+		addrs = append(addrs, addr)
+		base, ext := splitAddressExtension(addr, cfg.Policy.RecipientDelimiter)
+		if ext == "" {
+			continue
+		}
+		claimed, action := senderAddressClaimed(cfg, db, idp, req, addr)
+		if action != "DUNNO" {
+			return nil, action
+		}
+		if !claimed {
+			addrs = append(addrs, base)
+		}
+	}
+	return addrs, "DUNNO"
+}
+
+// Whether a mailbox, alias, send-as grant or app sender owns the address as
+// given. An IdP failure counts as unowned when lookup failures fail open.
+func senderAddressClaimed(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest, addr string) (bool, string) {
+	claimed, err := db.SenderAddressClaimed(addr)
+	if err != nil {
+		log.Printf("sqlite sender address lookup error: %v", err)
+		return false, reply(cfg, req, reasonInternalError)
+	}
+	if claimed {
+		return true, "DUNNO"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	exists, err := idp.EmailExists(ctx, addr)
+	if err != nil {
+		log.Printf("idp email exists lookup error for %s: %v", addr, err)
+		if failOpen(cfg, req.SenderDomain, req.RecipientDomain) {
+			return false, "DUNNO"
+		}
+		return false, reply(cfg, req, reasonLookupFailure)
+	}
+	return exists, "DUNNO"
+}
+
+func senderPolicy(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest) string {
+	sender := req.Sender
+	saslMethod := req.SASLMethod
+	saslUser := req.SASLUser
+
+	if saslMethod == "" {
+		// No authentication: bounces must be accepted (RFC 5321 4.5.5)
+		if sender == "" {
+			log.Printf("policy null sender: sasl_method=none client=%s action=allow", req.ClientAddress)
+			return "DUNNO"
+		}
+
+		// Block sending from local domains
 		senderLocal, err := db.DomainFromEmailIsLocal(sender)
 		if err != nil {
 			log.Printf("sqlite domain lookup error: %v", err)
-			return "451 4.3.0 Temporary internal error"
+			return reply(cfg, req, reasonInternalError)
+		}
+
+		if !senderLocal {
+			_, _, senderLocal, err = db.ResolveAliasDomain(sender)
+			if err != nil {
+				log.Printf("sqlite alias domain lookup error: %v", err)
+				return reply(cfg, req, reasonInternalError)
+			}
 		}
 
 		if senderLocal {
-			return "553 5.7.1 Sending from local domains requires authentication"
+			return reply(cfg, req, reasonSenderAuthRequired)
 		}
 
 		return "DUNNO"
 	}
 
-	if saslMethod == "xoauth2" || saslMethod == "oauthbearer" {
+	if action := domainAuthPolicy(cfg, req); action != "DUNNO" {
+		return action
+	}
+
+	senders, action := senderAddresses(cfg, db, idp, req)
+	if action != "DUNNO" {
+		return action
+	}
+
+	if isUserAuth(saslMethod) {
 		// User authenticated via OIDC/OAuth2
-		// - Allow all recipients
-		// - Allow sending from user primary email or aliases only
+		// - Require the configured IdP role or group, if any
+		// - Allow the null sender per policy.null_sender.users
+		// - Allow sending from user primary email, aliases or delegated
+		//   addresses only
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
+		if sp, ok := idp.(SendPermissionResolver); ok {
+			allowed, err := sp.UserMaySend(ctx, saslUser)
+			if err != nil {
+				log.Printf("idp send permission lookup error for %s: %v", saslUser, err)
+				if failOpen(cfg, req.SenderDomain, req.RecipientDomain) {
+					return "DUNNO"
+				}
+				return reply(cfg, req, reasonLookupFailure)
+			}
+			if !allowed {
+				log.Printf("policy send not permitted: sasl=%s", saslUser)
+				return reply(cfg, req, reasonSendNotPermitted)
+			}
+		}
+
+		if sender == "" {
+			return nullSenderPolicy(cfg, req, cfg.Policy.NullSender.Users)
+		}
+
 		email, ok, err := idp.ResolveUserEmail(ctx, saslUser)
 		if err != nil {
 			log.Printf("idp email-by-user lookup error for %s: %v", saslUser, err)
-			if cfg.Policy.IDPFailureMode == "dunno" {
+			if failOpen(cfg, req.SenderDomain, req.RecipientDomain) {
 				return "DUNNO"
 			}
-			return "451 4.3.0 Temporary authentication/lookup failure"
+			return reply(cfg, req, reasonLookupFailure)
 		}
 
-		// 1) sender == primary email
-		if ok && strings.EqualFold(sender, email) {
-			return "DUNNO"
-		}
+		for _, addr := range senders {
+			// 1) sender == primary email
+			if ok && strings.EqualFold(addr, email) {
+				return "DUNNO"
+			}
 
-		// 2) sender is sqlite alias belonging to this user
-		belongs, err := db.AliasBelongsTo(sender, saslUser)
-		if err != nil {
-			log.Printf("sqlite alias sender lookup error: %v", err)
-			return "451 4.3.0 Temporary internal error"
-		}
-		if belongs {
-			return "DUNNO"
+			// 2) sender is sqlite alias belonging to this user
+			belongs, err := db.AliasBelongsTo(addr, saslUser)
+			if err != nil {
+				log.Printf("sqlite alias sender lookup error: %v", err)
+				return reply(cfg, req, reasonInternalError)
+			}
+			if belongs {
+				return "DUNNO"
+			}
 		}
 
-		return "553 5.7.1 Sender not owned by authenticated user"
+		// 3) sender is delegated to this user
+		return sendAsPolicy(cfg, db, idp, req, senders)
 	}
 
-	if saslMethod == "plain" || saslMethod == "login" {
-		// App authenticatied via username/password
-		// - Allow all recipients
+	if isAppAuth(saslMethod) {
+		// App authenticated via username/password or client certificate
+		// - Allow submissions from the app networks only, if any
+		// - Allow the null sender per policy.null_sender.apps
 		// - Allow sending from email associated with app only
 
-		allowed, err := db.AppFromAllowed(saslUser, sender)
-		if err != nil {
-			log.Printf("sqlite app sender lookup error: %v", err)
-			return "451 4.3.0 Temporary internal error"
+		if action := appNetworkPolicy(cfg, db, req); action != "DUNNO" {
+			return action
 		}
-		if allowed {
-			return "DUNNO"
+
+		if sender == "" {
+			return nullSenderPolicy(cfg, req, cfg.Policy.NullSender.Apps)
+		}
+
+		for _, addr := range senders {
+			allowed, err := db.AppFromAllowed(saslUser, addr)
+			if err != nil {
+				log.Printf("sqlite app sender lookup error: %v", err)
+				return reply(cfg, req, reasonInternalError)
+			}
+			if allowed {
+				return "DUNNO"
+			}
 		}
 
-		return "553 5.7.1 Sender not owned by authenticated user"
+		return reply(cfg, req, reasonSenderNotOwned)
 	}
 
-	return "553 5.7.1 Unsupported authentication method"
+	return reply(cfg, req, reasonUnsupportedAuth)
 }
@@ -1,10 +1,15 @@
 package mailcloak
 
 import (
+	"bufio"
 	"context"
 	"errors"
+	"io"
+	"net"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"mailcloak/internal/mailcloak/testutil"
 )
@@ -176,7 +181,14 @@ func TestPolicy(t *testing.T) {
 				EmailExistsErr:      tc.idpErr,
 			}
 
-			got := policy(cfg, db, fakeIDP, tc.sender, tc.rcpt, tc.saslMethod, tc.saslUser)
+			req := &policyRequest{
+				State:      "RCPT",
+				SASLMethod: tc.saslMethod,
+				SASLUser:   tc.saslUser,
+				Sender:     tc.sender,
+				Recipient:  tc.rcpt,
+			}
+			got := policy(cfg, db, fakeIDP, req)
 			if got != tc.expect {
 				t.Fatalf("expected %q, got %q", tc.expect, got)
 			}
@@ -184,6 +196,338 @@ func TestPolicy(t *testing.T) {
 	}
 }
 
+func TestPolicySessionSenderStages(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertApp(t, sqlDB, "myapp", true)
+	testutil.InsertAppFrom(t, sqlDB, "myapp", "myapp@example.com", true)
+
+	cfg := testPolicyConfig("tempfail")
+	fakeIDP := &testutil.FakeIdentityResolver{}
+	sess := &policySession{}
+
+	mail := &policyRequest{State: "MAIL", Instance: "1.1", SASLMethod: "plain", SASLUser: "myapp", Sender: "nope@example.com"}
+	if got := sess.decide(cfg, db, fakeIDP, mail); got != "553 5.7.1 Sender not owned by authenticated user" {
+		t.Fatalf("expected sender rejection at MAIL, got %q", got)
+	}
+
+	mail = &policyRequest{State: "MAIL", Instance: "1.2", SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@example.com"}
+	if got := sess.decide(cfg, db, fakeIDP, mail); got != "DUNNO" {
+		t.Fatalf("expected sender accepted at MAIL, got %q", got)
+	}
+
+	// Revoke the sender: RCPT of the same transaction must not re-check it
+	if _, err := sqlDB.Exec(`DELETE FROM app_from WHERE app_id=?`, "myapp"); err != nil {
+		t.Fatalf("delete app_from: %v", err)
+	}
+	rcpt := &policyRequest{State: "RCPT", Instance: "1.2", SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@example.com", Recipient: "user@other.com"}
+	if got := sess.decide(cfg, db, fakeIDP, rcpt); got != "DUNNO" {
+		t.Fatalf("expected sender check to be skipped at RCPT, got %q", got)
+	}
+
+	// A new transaction is checked again
+	rcpt = &policyRequest{State: "RCPT", Instance: "1.3", SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@example.com", Recipient: "user@other.com"}
+	if got := sess.decide(cfg, db, fakeIDP, rcpt); got != "553 5.7.1 Sender not owned by authenticated user" {
+		t.Fatalf("expected sender re-check for a new transaction, got %q", got)
+	}
+
+	other := &policyRequest{State: "DATA", Instance: "1.3", SASLMethod: "plain", SASLUser: "myapp", Sender: "nope@example.com"}
+	if got := sess.decide(cfg, db, fakeIDP, other); got != "DUNNO" {
+		t.Fatalf("expected DUNNO for other states, got %q", got)
+	}
+}
+
+func TestMessagePolicy(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	fakeIDP := &testutil.FakeIdentityResolver{}
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.MessageLimits.Users = MessageLimits{MaxRecipients: 10, MaxSize: 1000}
+	cfg.Policy.MessageLimits.Apps = MessageLimits{MaxRecipients: 2}
+
+	cases := []struct {
+		name       string
+		saslMethod string
+		rcptCount  int
+		size       int64
+		expect     string
+	}{
+		{name: "user within limits", saslMethod: "xoauth2", rcptCount: 10, size: 1000, expect: "DUNNO"},
+		{name: "user too many recipients", saslMethod: "oauthbearer", rcptCount: 11, size: 10, expect: "552 5.5.3 Too many recipients"},
+		{name: "user too large", saslMethod: "xoauth2", rcptCount: 1, size: 1001, expect: "552 5.3.4 Message size exceeds limit"},
+		{name: "app too many recipients", saslMethod: "plain", rcptCount: 3, expect: "552 5.5.3 Too many recipients"},
+		{name: "app size unlimited", saslMethod: "login", rcptCount: 1, size: 1 << 30, expect: "DUNNO"},
+		{name: "unauthenticated not limited", saslMethod: "", rcptCount: 1000, size: 1 << 30, expect: "DUNNO"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &policyRequest{
+				State:          "END-OF-MESSAGE",
+				SASLMethod:     tc.saslMethod,
+				SASLUser:       "someone",
+				RecipientCount: tc.rcptCount,
+				Size:           tc.size,
+			}
+			if got := messagePolicy(cfg, db, fakeIDP, req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestPolicySessionEndOfMessageRecordsAcceptedMessages(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.RecordMessages = true
+	cfg.Policy.MessageLimits.Apps.MaxRecipients = 2
+	sess := &policySession{}
+
+	attrs := map[string]string{
+		"protocol_state":  "END-OF-MESSAGE",
+		"queue_id":        "ABC123",
+		"sasl_method":     "PLAIN",
+		"sasl_username":   "myapp",
+		"sender":          "MyApp@Example.com",
+		"client_address":  "192.0.2.1",
+		"recipient_count": "2",
+		"size":            "4096",
+	}
+	if got := handlePolicyRequest(cfg, db, &testutil.FakeIdentityResolver{}, sess, attrs); got != "DUNNO" {
+		t.Fatalf("expected accepted message, got %q", got)
+	}
+
+	attrs["queue_id"] = "DEF456"
+	attrs["recipient_count"] = "3"
+	if got := handlePolicyRequest(cfg, db, &testutil.FakeIdentityResolver{}, sess, attrs); got != "552 5.5.3 Too many recipients" {
+		t.Fatalf("expected rejected message, got %q", got)
+	}
+
+	rows, err := sqlDB.Query(`SELECT queue_id, sasl_method, sasl_username, sender, client_address, recipient_count, size FROM message_log`)
+	if err != nil {
+		t.Fatalf("query message_log: %v", err)
+	}
+	defer rows.Close()
+
+	var got []MessageRecord
+	for rows.Next() {
+		var rec MessageRecord
+		if err := rows.Scan(&rec.QueueID, &rec.SASLMethod, &rec.SASLUser, &rec.Sender, &rec.ClientAddress, &rec.RecipientCount, &rec.Size); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		got = append(got, rec)
+	}
+	want := MessageRecord{
+		QueueID:        "ABC123",
+		SASLMethod:     "plain",
+		SASLUser:       "myapp",
+		Sender:         "myapp@example.com",
+		ClientAddress:  "192.0.2.1",
+		RecipientCount: 2,
+		Size:           4096,
+	}
+	if len(got) != 1 || got[0] != want {
+		t.Fatalf("expected only the accepted message to be recorded, got %+v", got)
+	}
+}
+
+func TestPolicySessionPrependsIdentityHeader(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertApp(t, sqlDB, "myapp", true)
+	testutil.InsertAppFrom(t, sqlDB, "myapp", "myapp@example.com", true)
+
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.PrependHeaders.Enabled = true
+	cfg.Policy.PrependHeaders.UserHeader = "X-Mailcloak-Authenticated-User"
+	cfg.Policy.PrependHeaders.AppHeader = "X-Mailcloak-App-Id"
+	cfg.Policy.PrependHeaders.IncludeAuthMethod = true
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser: map[string]string{"alice": "alice@example.com"},
+	}
+	sess := &policySession{}
+
+	steps := []struct {
+		name   string
+		req    *policyRequest
+		expect string
+	}{
+		{
+			name:   "first user recipient",
+			req:    &policyRequest{State: "RCPT", Instance: "1", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice@example.com", Recipient: "a@other.com"},
+			expect: "PREPEND X-Mailcloak-Authenticated-User: alice; auth=xoauth2",
+		},
+		{
+			name:   "second user recipient",
+			req:    &policyRequest{State: "RCPT", Instance: "1", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice@example.com", Recipient: "b@other.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "rejected sender",
+			req:    &policyRequest{State: "RCPT", Instance: "2", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "nope@example.com", Recipient: "a@other.com"},
+			expect: "553 5.7.1 Sender not owned by authenticated user",
+		},
+		{
+			name:   "app recipient",
+			req:    &policyRequest{State: "RCPT", Instance: "3", SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@example.com", Recipient: "a@other.com"},
+			expect: "PREPEND X-Mailcloak-App-Id: myapp; auth=plain",
+		},
+		{
+			name:   "unauthenticated recipient",
+			req:    &policyRequest{State: "RCPT", Instance: "4", Sender: "user@other.com", Recipient: "missing@example.com"},
+			expect: "550 5.1.1 No such user",
+		},
+	}
+	for _, step := range steps {
+		if got := sess.decide(cfg, db, fakeIDP, step.req); got != step.expect {
+			t.Fatalf("%s: expected %q, got %q", step.name, step.expect, got)
+		}
+	}
+}
+
+func TestIdentityHeaderSanitizesValue(t *testing.T) {
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.PrependHeaders.Enabled = true
+	cfg.Policy.PrependHeaders.UserHeader = "X-User"
+
+	req := &policyRequest{SASLMethod: "oauthbearer", SASLUser: "ev\ril\x00"}
+	if got := identityHeader(cfg, req); got != "X-User: evil" {
+		t.Fatalf("expected sanitized header, got %q", got)
+	}
+
+	cfg.Policy.PrependHeaders.Enabled = false
+	if got := identityHeader(cfg, req); got != "" {
+		t.Fatalf("expected no header when disabled, got %q", got)
+	}
+}
+
+func writePolicyRequest(b *strings.Builder, kv ...string) {
+	for i := 0; i+1 < len(kv); i += 2 {
+		b.WriteString(kv[i] + "=" + kv[i+1] + "\n")
+	}
+	b.WriteString("\n")
+}
+
+func readPolicyResponse(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	blank, err := r.ReadString('\n')
+	if err != nil || blank != "\n" {
+		t.Fatalf("expected blank line after response, got %q err=%v", blank, err)
+	}
+	return strings.TrimRight(line, "\n")
+}
+
+func TestHandlePolicyConnPipelinedRequests(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailExistsSet: map[string]bool{"alice@example.com": true},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		handlePolicyConn(server, testPolicyConfig("tempfail"), db, fakeIDP)
+		close(done)
+	}()
+
+	var b strings.Builder
+	writePolicyRequest(&b, "request", "smtpd_access_policy", "protocol_state", "RCPT", "sender", "user@other.com", "recipient", "alice@example.com")
+	writePolicyRequest(&b, "request", "smtpd_access_policy", "protocol_state", "RCPT", "sender", "user@other.com", "recipient", "missing@example.com")
+	writePolicyRequest(&b, "request", "smtpd_access_policy", "protocol_state", "MAIL", "sender", "user@other.com")
+
+	go func() {
+		_, _ = io.WriteString(client, b.String())
+	}()
+
+	r := bufio.NewReader(client)
+	expected := []string{
+		"action=DUNNO",
+		"action=550 5.1.1 No such user",
+		"action=DUNNO",
+	}
+	for i, want := range expected {
+		if got := readPolicyResponse(t, r); got != want {
+			t.Fatalf("response %d: expected %q, got %q", i, want, got)
+		}
+	}
+
+	_ = client.Close()
+	<-done
+}
+
+func TestHandlePolicyConnReadTimeout(t *testing.T) {
+	db := &MailcloakDB{DB: testutil.NewSQLiteDB(t)}
+	defer db.Close()
+
+	cfg := testPolicyConfig("tempfail")
+	cfg.Server.ReadTimeoutSeconds = 1
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	before := PolicyConnStats.TimedOut.Load()
+	done := make(chan struct{})
+	go func() {
+		handlePolicyConn(server, cfg, db, &testutil.FakeIdentityResolver{})
+		close(done)
+	}()
+
+	// Start a request but never finish it
+	if _, err := io.WriteString(client, "protocol_state=RCPT\n"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler did not give up on a stalled request")
+	}
+	if got := PolicyConnStats.TimedOut.Load() - before; got != 1 {
+		t.Fatalf("expected 1 timed out connection, got %d", got)
+	}
+}
+
+func TestReadPolicyRequest(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("protocol_state=RCPT\r\nsender=a@b.c\n\nrecipient=x"))
+
+	req, err := readPolicyRequest(r)
+	if err != nil {
+		t.Fatalf("readPolicyRequest error: %v", err)
+	}
+	if req["protocol_state"] != "RCPT" || req["sender"] != "a@b.c" {
+		t.Fatalf("unexpected request: %v", req)
+	}
+
+	if _, err := readPolicyRequest(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF for truncated request, got %v", err)
+	}
+	if _, err := readPolicyRequest(r); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF at end of stream, got %v", err)
+	}
+}
+
 func TestRunPolicyOpenListenerError(t *testing.T) {
 	cfg := &Config{}
 	cfg.Sockets.PolicySocket = filepath.Join(t.TempDir(), "missing", "policy.sock")
@@ -196,3 +540,540 @@ func TestRunPolicyOpenListenerError(t *testing.T) {
 		t.Fatal("expected listener error")
 	}
 }
+
+func TestPolicyRecipientDelimiter(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertAlias(t, sqlDB, "alias@example.com", "alice", true)
+	testutil.InsertApp(t, sqlDB, "myapp", true)
+	testutil.InsertAppFrom(t, sqlDB, "myapp", "myapp@example.com", true)
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser:    map[string]string{"alice": "alice@example.com"},
+		EmailExistsSet: map[string]bool{"alice@example.com": true},
+	}
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.RecipientDelimiter = "+"
+
+	cases := []struct {
+		name   string
+		req    *policyRequest
+		expect string
+	}{
+		{
+			name:   "user rcpt extension",
+			req:    &policyRequest{Sender: "user@other.com", Recipient: "alice+news@example.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "alias rcpt extension",
+			req:    &policyRequest{Sender: "user@other.com", Recipient: "alias+news@example.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "unknown rcpt extension",
+			req:    &policyRequest{Sender: "user@other.com", Recipient: "nobody+news@example.com"},
+			expect: "550 5.1.1 No such user",
+		},
+		{
+			name:   "user sends from own extension",
+			req:    &policyRequest{SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice+shop@example.com", Recipient: "x@other.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "user sends from alias extension",
+			req:    &policyRequest{SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alias+shop@example.com", Recipient: "x@other.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "user sends from foreign extension",
+			req:    &policyRequest{SASLMethod: "xoauth2", SASLUser: "alice", Sender: "bob+alice@example.com", Recipient: "x@other.com"},
+			expect: "553 5.7.1 Sender not owned by authenticated user",
+		},
+		{
+			name:   "app sends from extension",
+			req:    &policyRequest{SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp+alerts@example.com", Recipient: "x@other.com"},
+			expect: "DUNNO",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := policy(cfg, db, fakeIDP, tc.req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+
+	// Without a delimiter addresses are compared verbatim
+	cfg.Policy.RecipientDelimiter = ""
+	req := &policyRequest{Sender: "user@other.com", Recipient: "alice+news@example.com"}
+	if got := policy(cfg, db, fakeIDP, req); got != "550 5.1.1 No such user" {
+		t.Fatalf("expected verbatim comparison without delimiter, got %q", got)
+	}
+}
+
+func TestPolicySenderExtensionOwnedAsGiven(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertAlias(t, sqlDB, "sales@example.com", "alice", true)
+	testutil.InsertAlias(t, sqlDB, "sales-team@example.com", "bob", true)
+	testutil.InsertSendAs(t, sqlDB, "user", "alice", "info@example.com", true)
+	testutil.InsertSendAs(t, sqlDB, "user", "bob", "info-desk@example.com", true)
+	testutil.InsertApp(t, sqlDB, "myapp", true)
+	testutil.InsertApp(t, sqlDB, "otherapp", true)
+	testutil.InsertAppFrom(t, sqlDB, "myapp", "noreply@example.com", true)
+	testutil.InsertAppFrom(t, sqlDB, "otherapp", "noreply-billing@example.com", true)
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser:    map[string]string{"john": "john@example.com", "alice": "alice@example.com"},
+		EmailExistsSet: map[string]bool{"john@example.com": true, "john-doe@example.com": true},
+	}
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.RecipientDelimiter = "+-"
+
+	cases := []struct {
+		name   string
+		req    *policyRequest
+		expect string
+	}{
+		{
+			name:   "extension of own mailbox",
+			req:    &policyRequest{SASLMethod: "xoauth2", SASLUser: "john", Sender: "john-shop@example.com", Recipient: "x@other.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "another user's mailbox",
+			req:    &policyRequest{SASLMethod: "xoauth2", SASLUser: "john", Sender: "john-doe@example.com", Recipient: "x@other.com"},
+			expect: "553 5.7.1 Sender not owned by authenticated user",
+		},
+		{
+			name:   "extension of own alias",
+			req:    &policyRequest{SASLMethod: "xoauth2", SASLUser: "alice", Sender: "sales+news@example.com", Recipient: "x@other.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "another user's alias",
+			req:    &policyRequest{SASLMethod: "xoauth2", SASLUser: "alice", Sender: "sales-team@example.com", Recipient: "x@other.com"},
+			expect: "553 5.7.1 Sender not owned by authenticated user",
+		},
+		{
+			name:   "extension of own send-as grant",
+			req:    &policyRequest{SASLMethod: "xoauth2", SASLUser: "alice", Sender: "info+news@example.com", Recipient: "x@other.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "another user's send-as grant",
+			req:    &policyRequest{SASLMethod: "xoauth2", SASLUser: "alice", Sender: "info-desk@example.com", Recipient: "x@other.com"},
+			expect: "553 5.7.1 Sender not owned by authenticated user",
+		},
+		{
+			name:   "extension of own app sender",
+			req:    &policyRequest{SASLMethod: "plain", SASLUser: "myapp", Sender: "noreply+alerts@example.com", Recipient: "x@other.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "another app's sender",
+			req:    &policyRequest{SASLMethod: "plain", SASLUser: "myapp", Sender: "noreply-billing@example.com", Recipient: "x@other.com"},
+			expect: "553 5.7.1 Sender not owned by authenticated user",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := policy(cfg, db, fakeIDP, tc.req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestPolicyDomainCatchall(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertDomain(t, sqlDB, "catchall.com", true)
+	testutil.SetDomainCatchall(t, sqlDB, "catchall.com", "postmaster")
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser: map[string]string{"postmaster": "postmaster@catchall.com"},
+	}
+	cfg := testPolicyConfig("tempfail")
+
+	req := &policyRequest{Sender: "user@other.com", Recipient: "random@catchall.com"}
+	if got := policy(cfg, db, fakeIDP, req); got != "DUNNO" {
+		t.Fatalf("expected catch-all to accept unknown recipient, got %q", got)
+	}
+
+	req = &policyRequest{Sender: "user@other.com", Recipient: "random@example.com"}
+	if got := policy(cfg, db, fakeIDP, req); got != "550 5.1.1 No such user" {
+		t.Fatalf("expected unknown recipient without catch-all to be rejected, got %q", got)
+	}
+
+	// The catch-all target does not own the addresses it receives
+	req = &policyRequest{SASLMethod: "xoauth2", SASLUser: "postmaster", Sender: "random@catchall.com", Recipient: "x@other.com"}
+	if got := policy(cfg, db, fakeIDP, req); got != "553 5.7.1 Sender not owned by authenticated user" {
+		t.Fatalf("expected catch-all address to be refused as sender, got %q", got)
+	}
+}
+
+func TestPolicyAliasDomains(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertAlias(t, sqlDB, "sales@example.com", "alice", true)
+	testutil.InsertAliasDomain(t, sqlDB, "example.org", "example.com", true)
+	testutil.InsertAliasDomain(t, sqlDB, "example.net", "example.com", false)
+	testutil.InsertApp(t, sqlDB, "myapp", true)
+	testutil.InsertAppFrom(t, sqlDB, "myapp", "myapp@example.com", true)
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser:    map[string]string{"alice": "alice@example.com"},
+		EmailExistsSet: map[string]bool{"alice@example.com": true},
+	}
+	cfg := testPolicyConfig("tempfail")
+
+	cases := []struct {
+		name   string
+		req    *policyRequest
+		expect string
+	}{
+		{
+			name:   "user rcpt in alias domain",
+			req:    &policyRequest{Sender: "user@other.com", Recipient: "alice@example.org"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "alias rcpt in alias domain",
+			req:    &policyRequest{Sender: "user@other.com", Recipient: "sales@example.net"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "unknown rcpt in alias domain",
+			req:    &policyRequest{Sender: "user@other.com", Recipient: "nobody@example.org"},
+			expect: "550 5.1.1 No such user",
+		},
+		{
+			name:   "unauthenticated alias domain sender",
+			req:    &policyRequest{Sender: "alice@example.net", Recipient: "alice@example.com"},
+			expect: "553 5.7.1 Sending from local domains requires authentication",
+		},
+		{
+			name:   "user sends from mapped alias domain",
+			req:    &policyRequest{SASLMethod: "xoauth2", SASLUser: "alice", Sender: "sales@example.org", Recipient: "x@other.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "user sends from alias domain without sender mapping",
+			req:    &policyRequest{SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice@example.net", Recipient: "x@other.com"},
+			expect: "553 5.7.1 Sender not owned by authenticated user",
+		},
+		{
+			name:   "app sends from mapped alias domain",
+			req:    &policyRequest{SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@example.org", Recipient: "x@other.com"},
+			expect: "DUNNO",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := policy(cfg, db, fakeIDP, tc.req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestPolicyAppNetworks(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertApp(t, sqlDB, "myapp", true)
+	testutil.InsertAppFrom(t, sqlDB, "myapp", "myapp@example.com", true)
+	testutil.InsertAppNetwork(t, sqlDB, "myapp", "192.0.2.0/24")
+	testutil.InsertAppNetwork(t, sqlDB, "myapp", "2001:db8::1")
+	testutil.InsertApp(t, sqlDB, "anywhere", true)
+	testutil.InsertAppFrom(t, sqlDB, "anywhere", "anywhere@example.com", true)
+
+	cfg := testPolicyConfig("tempfail")
+	fakeIDP := &testutil.FakeIdentityResolver{}
+
+	cases := []struct {
+		name   string
+		app    string
+		client string
+		expect string
+	}{
+		{name: "allowed network", app: "myapp", client: "192.0.2.25", expect: "DUNNO"},
+		{name: "allowed ipv6 host", app: "myapp", client: "2001:db8::1", expect: "DUNNO"},
+		{name: "other network", app: "myapp", client: "198.51.100.7", expect: "554 5.7.1 Submission not allowed from this network"},
+		{name: "missing client address", app: "myapp", client: "", expect: "554 5.7.1 Submission not allowed from this network"},
+		{name: "unrestricted app", app: "anywhere", client: "198.51.100.7", expect: "DUNNO"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &policyRequest{
+				State:         "MAIL",
+				SASLMethod:    "plain",
+				SASLUser:      tc.app,
+				Sender:        tc.app + "@example.com",
+				ClientAddress: tc.client,
+			}
+			if got := senderPolicy(cfg, db, fakeIDP, req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestPolicyAppRecipients(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertApp(t, sqlDB, "monitoring", true)
+	testutil.InsertAppFrom(t, sqlDB, "monitoring", "monitoring@example.com", true)
+	testutil.InsertAppRcpt(t, sqlDB, "monitoring", "oncall@partner.com", true)
+	testutil.InsertAppRcpt(t, sqlDB, "monitoring", "ops.example.net", true)
+	testutil.InsertAppRcpt(t, sqlDB, "monitoring", "*.alerts.example.org", true)
+	testutil.InsertAppRcpt(t, sqlDB, "monitoring", "team-*@example.io", true)
+	testutil.InsertAppRcpt(t, sqlDB, "monitoring", "old@partner.com", false)
+	testutil.InsertApp(t, sqlDB, "newsletter", true)
+	testutil.InsertAppFrom(t, sqlDB, "newsletter", "news@example.com", true)
+
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.RecipientDelimiter = "+"
+	fakeIDP := &testutil.FakeIdentityResolver{}
+
+	cases := []struct {
+		name   string
+		app    string
+		rcpt   string
+		expect string
+	}{
+		{name: "exact address", app: "monitoring", rcpt: "OnCall@Partner.com", expect: "DUNNO"},
+		{name: "exact address with extension", app: "monitoring", rcpt: "oncall+pager@partner.com", expect: "DUNNO"},
+		{name: "domain", app: "monitoring", rcpt: "anyone@ops.example.net", expect: "DUNNO"},
+		{name: "domain wildcard", app: "monitoring", rcpt: "x@eu.alerts.example.org", expect: "DUNNO"},
+		{name: "address wildcard", app: "monitoring", rcpt: "team-db@example.io", expect: "DUNNO"},
+		{name: "address wildcard mismatch", app: "monitoring", rcpt: "boss@example.io", expect: "550 5.7.1 Recipient not allowed for this app"},
+		{name: "disabled pattern", app: "monitoring", rcpt: "old@partner.com", expect: "550 5.7.1 Recipient not allowed for this app"},
+		{name: "outside address", app: "monitoring", rcpt: "victim@gmail.com", expect: "550 5.7.1 Recipient not allowed for this app"},
+		{name: "unrestricted app", app: "newsletter", rcpt: "victim@gmail.com", expect: "DUNNO"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &policyRequest{
+				State:      "RCPT",
+				SASLMethod: "login",
+				SASLUser:   tc.app,
+				Recipient:  strings.ToLower(tc.rcpt),
+			}
+			if got := recipientPolicy(cfg, db, fakeIDP, req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestPolicySendPermission(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser: map[string]string{"alice": "alice@example.com", "mallory": "mallory@example.com"},
+		SendDenied:  map[string]bool{"mallory": true},
+	}
+	cfg := testPolicyConfig("tempfail")
+	req := func(user, sender string) *policyRequest {
+		return &policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: user, Sender: sender, Recipient: "x@remote.net"}
+	}
+
+	if got := policy(cfg, db, fakeIDP, req("alice", "alice@example.com")); got != "DUNNO" {
+		t.Fatalf("expected permitted user to send, got %q", got)
+	}
+	if got := policy(cfg, db, fakeIDP, req("mallory", "mallory@example.com")); got != "550 5.7.1 User is not permitted to send mail" {
+		t.Fatalf("expected user without role to be rejected, got %q", got)
+	}
+
+	fakeIDP.UserMaySendErr = errors.New("idp down")
+	if got := policy(cfg, db, fakeIDP, req("alice", "alice@example.com")); got != "451 4.3.0 Temporary authentication/lookup failure" {
+		t.Fatalf("expected tempfail on lookup error, got %q", got)
+	}
+	cfg.Policy.IDPFailureMode = "dunno"
+	if got := policy(cfg, db, fakeIDP, req("alice", "alice@example.com")); got != "DUNNO" {
+		t.Fatalf("expected DUNNO on lookup error in dunno mode, got %q", got)
+	}
+}
+
+func TestPolicyInternalOnlyUsers(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertInternalOnlyUser(t, sqlDB, "kiosk")
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser: map[string]string{
+			"alice":  "alice@example.com",
+			"kiosk":  "kiosk@example.com",
+			"intern": "intern@example.com",
+		},
+		EmailExistsSet: map[string]bool{"alice@example.com": true},
+		GroupsByUser:   map[string][]string{"intern": {"Interns"}},
+	}
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.InternalOnlyGroup = "interns"
+
+	cases := []struct {
+		name   string
+		user   string
+		rcpt   string
+		expect string
+	}{
+		{name: "regular user external", user: "alice", rcpt: "x@remote.net", expect: "DUNNO"},
+		{name: "table user local", user: "kiosk", rcpt: "alice@example.com", expect: "DUNNO"},
+		{name: "table user external", user: "kiosk", rcpt: "x@remote.net", expect: "550 5.7.1 External recipients not allowed for this user"},
+		{name: "group member local", user: "intern", rcpt: "alice@example.com", expect: "DUNNO"},
+		{name: "group member external", user: "intern", rcpt: "x@remote.net", expect: "550 5.7.1 External recipients not allowed for this user"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &policyRequest{
+				State:      "RCPT",
+				SASLMethod: "xoauth2",
+				SASLUser:   tc.user,
+				Sender:     tc.user + "@example.com",
+				Recipient:  tc.rcpt,
+			}
+			if got := policy(cfg, db, fakeIDP, req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+
+	fakeIDP.UserGroupsErr = errors.New("idp down")
+	req := &policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice@example.com", Recipient: "x@remote.net"}
+	if got := policy(cfg, db, fakeIDP, req); got != "451 4.3.0 Temporary authentication/lookup failure" {
+		t.Fatalf("expected tempfail on groups lookup error, got %q", got)
+	}
+}
+
+func TestPolicyNullSender(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertApp(t, sqlDB, "myapp", true)
+	testutil.InsertApp(t, sqlDB, "lockedapp", true)
+	testutil.InsertAppNetwork(t, sqlDB, "lockedapp", "10.0.0.0/8")
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser:    map[string]string{"alice": "alice@example.com", "mallory": "mallory@example.com"},
+		EmailExistsSet: map[string]bool{"alice@example.com": true},
+		SendDenied:     map[string]bool{"mallory": true},
+	}
+
+	cases := []struct {
+		name       string
+		users      string
+		apps       string
+		saslMethod string
+		saslUser   string
+		client     string
+		rcpt       string
+		expect     string
+	}{
+		{name: "unauthenticated bounce", rcpt: "alice@example.com", expect: "DUNNO"},
+		{name: "unauthenticated bounce to unknown user", rcpt: "nobody@example.com", expect: "550 5.1.1 No such user"},
+		{name: "user rejected by default", saslMethod: "xoauth2", saslUser: "alice", rcpt: "x@remote.net", expect: "553 5.7.1 Null sender not allowed for authenticated submissions"},
+		{name: "user allowed", users: "allow", saslMethod: "xoauth2", saslUser: "alice", rcpt: "x@remote.net", expect: "DUNNO"},
+		{name: "user without send permission", users: "allow", saslMethod: "xoauth2", saslUser: "mallory", rcpt: "x@remote.net", expect: "550 5.7.1 User is not permitted to send mail"},
+		{name: "app rejected by default", saslMethod: "plain", saslUser: "myapp", rcpt: "x@remote.net", expect: "553 5.7.1 Null sender not allowed for authenticated submissions"},
+		{name: "app allowed", apps: "allow", saslMethod: "login", saslUser: "myapp", rcpt: "x@remote.net", expect: "DUNNO"},
+		{name: "app outside its networks", apps: "allow", saslMethod: "plain", saslUser: "lockedapp", client: "192.0.2.1", rcpt: "x@remote.net", expect: "554 5.7.1 Submission not allowed from this network"},
+		{name: "unsupported auth", users: "allow", apps: "allow", saslMethod: "cram-md5", saslUser: "alice", rcpt: "x@remote.net", expect: "553 5.7.1 Unsupported authentication method"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testPolicyConfig("tempfail")
+			cfg.Policy.NullSender.Users = tc.users
+			cfg.Policy.NullSender.Apps = tc.apps
+			req := &policyRequest{
+				State:         "RCPT",
+				SASLMethod:    tc.saslMethod,
+				SASLUser:      tc.saslUser,
+				ClientAddress: tc.client,
+				Recipient:     tc.rcpt,
+			}
+			if got := policy(cfg, db, fakeIDP, req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestPolicyInternationalizedAddresses(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	// mailcloakctl stores domains as A-labels
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "xn--bcher-kva.example", true)
+	testutil.InsertAlias(t, sqlDB, "info@xn--bcher-kva.example", "alice", true)
+
+	cfg := testPolicyConfig("tempfail")
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser: map[string]string{"alice": "alice@xn--bcher-kva.example"},
+	}
+
+	cases := []struct {
+		name   string
+		sasl   string
+		sender string
+		rcpt   string
+		expect string
+	}{
+		{name: "alias in U-labels", sender: "x@remote.net", rcpt: "Info@Bücher.example", expect: "DUNNO"},
+		{name: "unknown user of local IDN domain", sender: "x@remote.net", rcpt: "nobody@bücher.example", expect: "550 5.1.1 No such user"},
+		{name: "unauthenticated local IDN sender", sender: "alice@BÜCHER.example", rcpt: "info@bücher.example", expect: "553 5.7.1 Sending from local domains requires authentication"},
+		{name: "user sending from U-label address", sasl: "alice", sender: "Alice@Bücher.example", rcpt: "x@remote.net", expect: "DUNNO"},
+		{name: "user sending from A-label address", sasl: "alice", sender: "alice@xn--bcher-kva.example", rcpt: "x@remote.net", expect: "DUNNO"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			attrs := map[string]string{
+				"protocol_state": "RCPT",
+				"sender":         tc.sender,
+				"recipient":      tc.rcpt,
+			}
+			if tc.sasl != "" {
+				attrs["sasl_method"] = "XOAUTH2"
+				attrs["sasl_username"] = tc.sasl
+			}
+			if got := handlePolicyRequest(cfg, db, fakeIDP, &policySession{}, attrs); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
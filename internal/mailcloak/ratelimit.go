@@ -0,0 +1,106 @@
+package mailcloak
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// Rate events older than the largest window are useless
+const rateEventRetention = 24 * time.Hour
+
+type rateWindow struct {
+	name          string
+	length        time.Duration
+	maxMessages   int
+	maxRecipients int
+}
+
+func (l RateLimits) windows() []rateWindow {
+	return []rateWindow{
+		{name: "minute", length: time.Minute, maxMessages: l.MessagesPerMinute, maxRecipients: l.RecipientsPerMinute},
+		{name: "hour", length: time.Hour, maxMessages: l.MessagesPerHour, maxRecipients: l.RecipientsPerHour},
+		{name: "day", length: 24 * time.Hour, maxMessages: l.MessagesPerDay, maxRecipients: l.RecipientsPerDay},
+	}
+}
+
+func (l RateLimits) enabled() bool {
+	return l != RateLimits{}
+}
+
+// Applies the per-app overrides on top of the defaults
+func (l RateLimits) withOverrides(o AppRateLimits) RateLimits {
+	if o.MessagesPerMinute.Valid {
+		l.MessagesPerMinute = int(o.MessagesPerMinute.Int64)
+	}
+	if o.MessagesPerHour.Valid {
+		l.MessagesPerHour = int(o.MessagesPerHour.Int64)
+	}
+	if o.MessagesPerDay.Valid {
+		l.MessagesPerDay = int(o.MessagesPerDay.Int64)
+	}
+	if o.RecipientsPerMinute.Valid {
+		l.RecipientsPerMinute = int(o.RecipientsPerMinute.Int64)
+	}
+	if o.RecipientsPerHour.Valid {
+		l.RecipientsPerHour = int(o.RecipientsPerHour.Int64)
+	}
+	if o.RecipientsPerDay.Valid {
+		l.RecipientsPerDay = int(o.RecipientsPerDay.Int64)
+	}
+	return l
+}
+
+// Checks the sending rate of an authenticated user or app before accepting
+// a recipient, then records it. Counters live in SQLite so that they
+// survive restarts.
+func ratePolicy(cfg *Config, db *MailcloakDB, req *policyRequest) string {
+	if req.SASLUser == "" || !(isUserAuth(req.SASLMethod) || isAppAuth(req.SASLMethod)) {
+		return "DUNNO"
+	}
+
+	limits := cfg.Policy.RateLimits
+	if isAppAuth(req.SASLMethod) {
+		overrides, err := db.AppRateLimits(req.SASLUser)
+		if err != nil {
+			log.Printf("sqlite app rate limits lookup error: %v", err)
+			return reply(cfg, req, reasonInternalError)
+		}
+		limits = limits.withOverrides(overrides)
+	}
+	if !limits.enabled() {
+		return "DUNNO"
+	}
+
+	// Without a transaction id every recipient counts as its own message
+	now := time.Now()
+	instance := req.Instance
+	if instance == "" {
+		instance = "noinstance-" + strconv.FormatInt(now.UnixNano(), 10)
+	}
+
+	for _, w := range limits.windows() {
+		if w.maxMessages <= 0 && w.maxRecipients <= 0 {
+			continue
+		}
+		messages, recipients, seen, err := db.RateUsage(req.SASLUser, instance, now.Add(-w.length))
+		if err != nil {
+			log.Printf("sqlite rate usage lookup error: %v", err)
+			return reply(cfg, req, reasonInternalError)
+		}
+		if w.maxMessages > 0 && !seen && messages >= w.maxMessages {
+			log.Printf("policy rate limit: sasl=%s messages per %s=%d max=%d", req.SASLUser, w.name, messages, w.maxMessages)
+			return reply(cfg, req, reasonRateLimited)
+		}
+		if w.maxRecipients > 0 && recipients >= w.maxRecipients {
+			log.Printf("policy rate limit: sasl=%s recipients per %s=%d max=%d", req.SASLUser, w.name, recipients, w.maxRecipients)
+			return reply(cfg, req, reasonRateLimited)
+		}
+	}
+
+	// Failing to record must not block mail
+	if err := db.RecordRateEvent(req.SASLUser, instance, req.Recipient, now); err != nil {
+		log.Printf("sqlite rate event error: %v", err)
+	}
+	return "DUNNO"
+}
@@ -0,0 +1,132 @@
+package mailcloak
+
+import (
+	"testing"
+	"time"
+
+	"mailcloak/internal/mailcloak/testutil"
+)
+
+func rateRequest(method, user, instance, rcpt string) *policyRequest {
+	return &policyRequest{
+		State:      "RCPT",
+		Instance:   instance,
+		SASLMethod: method,
+		SASLUser:   user,
+		Recipient:  rcpt,
+	}
+}
+
+func TestRatePolicyMessagesAndRecipients(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.RateLimits = RateLimits{MessagesPerMinute: 2, RecipientsPerHour: 4}
+
+	steps := []struct {
+		instance string
+		rcpt     string
+		expect   string
+	}{
+		{instance: "m1", rcpt: "a@other.com", expect: "DUNNO"},
+		{instance: "m1", rcpt: "b@other.com", expect: "DUNNO"},
+		{instance: "m2", rcpt: "a@other.com", expect: "DUNNO"},
+		// third message within a minute
+		{instance: "m3", rcpt: "a@other.com", expect: "452 4.7.1 Sending rate limit exceeded, try again later"},
+		// more recipients for an already counted message
+		{instance: "m2", rcpt: "c@other.com", expect: "DUNNO"},
+		{instance: "m2", rcpt: "d@other.com", expect: "452 4.7.1 Sending rate limit exceeded, try again later"},
+	}
+	for i, step := range steps {
+		got := ratePolicy(cfg, db, rateRequest("xoauth2", "alice", step.instance, step.rcpt))
+		if got != step.expect {
+			t.Fatalf("step %d: expected %q, got %q", i, step.expect, got)
+		}
+	}
+
+	// Other identities have their own counters
+	if got := ratePolicy(cfg, db, rateRequest("xoauth2", "bob", "m4", "a@other.com")); got != "DUNNO" {
+		t.Fatalf("expected bob to be allowed, got %q", got)
+	}
+}
+
+func TestRatePolicyIgnoresExpiredEvents(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.RateLimits = RateLimits{MessagesPerHour: 1}
+
+	// Counters are persisted, so events from before a restart still count
+	if err := db.RecordRateEvent("alice", "old", "a@other.com", time.Now().Add(-30*time.Minute)); err != nil {
+		t.Fatalf("RecordRateEvent error: %v", err)
+	}
+	if got := ratePolicy(cfg, db, rateRequest("oauthbearer", "alice", "new", "a@other.com")); got != "452 4.7.1 Sending rate limit exceeded, try again later" {
+		t.Fatalf("expected persisted event to count, got %q", got)
+	}
+
+	if _, err := sqlDB.Exec(`UPDATE rate_events SET created_at=?`, time.Now().Add(-2*time.Hour).Unix()); err != nil {
+		t.Fatalf("age events: %v", err)
+	}
+	if got := ratePolicy(cfg, db, rateRequest("oauthbearer", "alice", "new", "a@other.com")); got != "DUNNO" {
+		t.Fatalf("expected expired event to be ignored, got %q", got)
+	}
+}
+
+func TestRatePolicyAppOverrides(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertApp(t, sqlDB, "bulk", true)
+	testutil.InsertApp(t, sqlDB, "plainapp", true)
+	if _, err := sqlDB.Exec(`UPDATE apps SET max_messages_per_minute=0, max_recipients_per_minute=2 WHERE app_id=?`, "bulk"); err != nil {
+		t.Fatalf("set overrides: %v", err)
+	}
+
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.RateLimits = RateLimits{MessagesPerMinute: 1}
+
+	// Default limit applies to apps without overrides
+	if got := ratePolicy(cfg, db, rateRequest("plain", "plainapp", "m1", "a@other.com")); got != "DUNNO" {
+		t.Fatalf("expected first message allowed, got %q", got)
+	}
+	if got := ratePolicy(cfg, db, rateRequest("plain", "plainapp", "m2", "a@other.com")); got != "452 4.7.1 Sending rate limit exceeded, try again later" {
+		t.Fatalf("expected default limit to apply, got %q", got)
+	}
+
+	// Overridden app: messages unlimited, recipients capped
+	for i, instance := range []string{"m1", "m2"} {
+		if got := ratePolicy(cfg, db, rateRequest("login", "bulk", instance, "a@other.com")); got != "DUNNO" {
+			t.Fatalf("message %d: expected override to lift message limit, got %q", i, got)
+		}
+	}
+	if got := ratePolicy(cfg, db, rateRequest("login", "bulk", "m3", "a@other.com")); got != "452 4.7.1 Sending rate limit exceeded, try again later" {
+		t.Fatalf("expected overridden recipient limit to apply, got %q", got)
+	}
+}
+
+func TestRatePolicySkipsUnauthenticated(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.RateLimits = RateLimits{MessagesPerMinute: 1}
+
+	for i := 0; i < 3; i++ {
+		if got := ratePolicy(cfg, db, rateRequest("", "", "m", "alice@example.com")); got != "DUNNO" {
+			t.Fatalf("expected unauthenticated mail to be unlimited, got %q", got)
+		}
+	}
+	var n int
+	if err := sqlDB.QueryRow(`SELECT COUNT(*) FROM rate_events`).Scan(&n); err != nil {
+		t.Fatalf("count events: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no rate events for unauthenticated mail, got %d", n)
+	}
+}
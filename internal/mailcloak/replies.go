@@ -0,0 +1,143 @@
+package mailcloak
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Named reasons for the replies mailcloak builds itself
+const (
+	reasonInternalError      = "internal_error"
+	reasonLookupFailure      = "lookup_failure"
+	reasonNoSuchUser         = "no_such_user"
+	reasonRelayDenied        = "relay_denied"
+	reasonSenderAuthRequired = "sender_auth_required"
+	reasonSenderNotOwned     = "sender_not_owned"
+	reasonUnsupportedAuth    = "unsupported_auth"
+	reasonAuthMethodDenied   = "auth_method_denied"
+	reasonNullSender         = "null_sender"
+	reasonSendNotPermitted   = "send_not_permitted"
+	reasonAppNetworkDenied   = "app_network_denied"
+	reasonAppRecipientDenied = "app_recipient_denied"
+	reasonInternalOnly       = "internal_only"
+	reasonTooManyRecipients  = "too_many_recipients"
+	reasonMessageTooLarge    = "message_too_large"
+	reasonRateLimited        = "rate_limited"
+	reasonGreylisted         = "greylisted"
+)
+
+// SMTP reply for a reason. Text may contain the placeholders {sender},
+// {recipient}, {sasl_username}, {sasl_method}, {client_address} and
+// {queue_id}.
+type ReplyTemplate struct {
+	Code   string `yaml:"code"`   // e.g. "553"
+	Status string `yaml:"status"` // enhanced status code, e.g. "5.7.1"
+	Text   string `yaml:"text"`
+}
+
+var defaultReplies = map[string]ReplyTemplate{
+	reasonInternalError:      {"451", "4.3.0", "Temporary internal error"},
+	reasonLookupFailure:      {"451", "4.3.0", "Temporary authentication/lookup failure"},
+	reasonNoSuchUser:         {"550", "5.1.1", "No such user"},
+	reasonRelayDenied:        {"550", "5.7.1", "Recipient domain not local"},
+	reasonSenderAuthRequired: {"553", "5.7.1", "Sending from local domains requires authentication"},
+	reasonSenderNotOwned:     {"553", "5.7.1", "Sender not owned by authenticated user"},
+	reasonUnsupportedAuth:    {"553", "5.7.1", "Unsupported authentication method"},
+	reasonAuthMethodDenied:   {"553", "5.7.1", "Authentication method not allowed for this sender domain"},
+	reasonNullSender:         {"553", "5.7.1", "Null sender not allowed for authenticated submissions"},
+	reasonSendNotPermitted:   {"550", "5.7.1", "User is not permitted to send mail"},
+	reasonAppNetworkDenied:   {"554", "5.7.1", "Submission not allowed from this network"},
+	reasonAppRecipientDenied: {"550", "5.7.1", "Recipient not allowed for this app"},
+	reasonInternalOnly:       {"550", "5.7.1", "External recipients not allowed for this user"},
+	reasonTooManyRecipients:  {"552", "5.5.3", "Too many recipients"},
+	reasonMessageTooLarge:    {"552", "5.3.4", "Message size exceeds limit"},
+	reasonRateLimited:        {"452", "4.7.1", "Sending rate limit exceeded, try again later"},
+	reasonGreylisted:         {"450", "4.7.1", "Greylisted, please try again later"},
+}
+
+var (
+	replyCodeRe   = regexp.MustCompile(`^[45][0-9][0-9]$`)
+	replyStatusRe = regexp.MustCompile(`^[45]\.[0-9]{1,3}\.[0-9]{1,3}$`)
+	// transport:destination of a FILTER action, e.g. smtp:[127.0.0.1]:10026
+	filterNexthopRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+:\S*$`)
+)
+
+// Render the reply for a reason and remember the reason on the request
+func reply(cfg *Config, req *policyRequest, reason string) string {
+	t, ok := cfg.Policy.Replies[reason]
+	if !ok {
+		t = defaultReplies[reason]
+	}
+	req.Reason = reason
+
+	text := strings.NewReplacer(
+		"{sender}", req.Sender,
+		"{recipient}", req.Recipient,
+		"{sasl_username}", req.SASLUser,
+		"{sasl_method}", req.SASLMethod,
+		"{client_address}", req.ClientAddress,
+		"{queue_id}", req.QueueID,
+	).Replace(t.Text)
+
+	// Quarantine instead of rejecting, see policy.reason_actions
+	switch action := cfg.Policy.ReasonActions[reason]; {
+	case action == "hold":
+		return "HOLD " + sanitizeHeaderValue(text)
+	case strings.HasPrefix(action, "filter "):
+		return "FILTER " + strings.TrimPrefix(action, "filter ")
+	}
+	return t.Code + " " + t.Status + " " + sanitizeHeaderValue(text)
+}
+
+// Merge the configured replies over the defaults and check them
+func validateReplies(cfg *Config) error {
+	merged := make(map[string]ReplyTemplate, len(defaultReplies))
+	for reason, t := range defaultReplies {
+		merged[reason] = t
+	}
+	for reason, o := range cfg.Policy.Replies {
+		t, ok := defaultReplies[reason]
+		if !ok {
+			return fmt.Errorf("unknown reason %q in policy.replies", reason)
+		}
+		if o.Code != "" {
+			t.Code = o.Code
+		}
+		if o.Status != "" {
+			t.Status = o.Status
+		}
+		if o.Text != "" {
+			t.Text = o.Text
+		}
+		if !replyCodeRe.MatchString(t.Code) || !replyStatusRe.MatchString(t.Status) || t.Code[0] != t.Status[0] {
+			return fmt.Errorf("policy.replies.%s: code %q and status %q must be a matching 4xx/5xx pair", reason, t.Code, t.Status)
+		}
+		if strings.ContainsAny(t.Text, "\r\n") {
+			return fmt.Errorf("policy.replies.%s: text must be a single line", reason)
+		}
+		merged[reason] = t
+	}
+	cfg.Policy.Replies = merged
+	return nil
+}
+
+// Checks policy.reason_actions: "reject" (the default), "hold" or
+// "filter transport:destination"
+func validateReasonActions(cfg *Config) error {
+	for reason, action := range cfg.Policy.ReasonActions {
+		if _, ok := defaultReplies[reason]; !ok {
+			return fmt.Errorf("unknown reason %q in policy.reason_actions", reason)
+		}
+		fields := strings.Fields(action)
+		switch {
+		case len(fields) == 1 && (fields[0] == "reject" || fields[0] == "hold"):
+			cfg.Policy.ReasonActions[reason] = fields[0]
+		case len(fields) == 2 && fields[0] == "filter" && filterNexthopRe.MatchString(fields[1]):
+			cfg.Policy.ReasonActions[reason] = "filter " + fields[1]
+		default:
+			return fmt.Errorf("policy.reason_actions.%s: unsupported action %q", reason, action)
+		}
+	}
+	return nil
+}
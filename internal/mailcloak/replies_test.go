@@ -0,0 +1,212 @@
+package mailcloak
+
+import (
+	"strings"
+	"testing"
+
+	"mailcloak/internal/mailcloak/testutil"
+)
+
+func TestReplyDefaults(t *testing.T) {
+	cfg := &Config{}
+	req := &policyRequest{Sender: "bob@example.com"}
+	if got := reply(cfg, req, reasonSenderNotOwned); got != "553 5.7.1 Sender not owned by authenticated user" {
+		t.Fatalf("unexpected default reply: %q", got)
+	}
+	if req.Reason != reasonSenderNotOwned {
+		t.Fatalf("expected reason to be recorded, got %q", req.Reason)
+	}
+}
+
+func TestReplyTemplates(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.Replies = map[string]ReplyTemplate{
+		reasonSenderNotOwned: {Text: "{sasl_username} may not send as {sender}, see https://help.example.com/smtp"},
+		reasonNoSuchUser:     {Code: "450", Status: "4.1.1", Text: "Unknown recipient {recipient}"},
+	}
+	if err := validateReplies(cfg); err != nil {
+		t.Fatalf("validateReplies error: %v", err)
+	}
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser: map[string]string{"alice": "alice@example.com"},
+	}
+
+	req := &policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "bob@example.com", Recipient: "x@other.com"}
+	want := "553 5.7.1 alice may not send as bob@example.com, see https://help.example.com/smtp"
+	if got := policy(cfg, db, fakeIDP, req); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	req = &policyRequest{State: "RCPT", Sender: "user@other.com", Recipient: "nobody@example.com"}
+	if got := policy(cfg, db, fakeIDP, req); got != "450 4.1.1 Unknown recipient nobody@example.com" {
+		t.Fatalf("unexpected reply: %q", got)
+	}
+	if req.Reason != reasonNoSuchUser {
+		t.Fatalf("expected reason %q, got %q", reasonNoSuchUser, req.Reason)
+	}
+
+	// untouched reasons keep their default
+	req = &policyRequest{State: "RCPT", Sender: "user@other.com", Recipient: "a@other.com"}
+	if got := policy(cfg, db, fakeIDP, req); got != "550 5.7.1 Recipient domain not local" {
+		t.Fatalf("unexpected reply: %q", got)
+	}
+}
+
+func TestReplySanitizesPlaceholders(t *testing.T) {
+	cfg := &Config{}
+	cfg.Policy.Replies = map[string]ReplyTemplate{
+		reasonRelayDenied: {Code: "550", Status: "5.7.1", Text: "No relay for {recipient}"},
+	}
+	req := &policyRequest{Recipient: "a@other.com\r\nDUNNO"}
+	if got := reply(cfg, req, reasonRelayDenied); got != "550 5.7.1 No relay for a@other.comDUNNO" {
+		t.Fatalf("unexpected reply: %q", got)
+	}
+}
+
+func TestValidateRepliesErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		replies map[string]ReplyTemplate
+		wantErr string
+	}{
+		{name: "unknown reason", replies: map[string]ReplyTemplate{"nope": {Text: "x"}}, wantErr: "unknown reason"},
+		{name: "class mismatch", replies: map[string]ReplyTemplate{reasonNoSuchUser: {Code: "450"}}, wantErr: "matching 4xx/5xx pair"},
+		{name: "bad code", replies: map[string]ReplyTemplate{reasonNoSuchUser: {Code: "250", Status: "2.0.0"}}, wantErr: "matching 4xx/5xx pair"},
+		{name: "multi-line text", replies: map[string]ReplyTemplate{reasonNoSuchUser: {Text: "a\nb"}}, wantErr: "single line"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Policy.Replies = tc.replies
+			err := validateReplies(cfg)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestReasonActionsQuarantine(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertApp(t, sqlDB, "myapp", true)
+	testutil.InsertAppFrom(t, sqlDB, "myapp", "myapp@example.com", true)
+
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.ReasonActions = map[string]string{
+		reasonSenderNotOwned:    "  hold ",
+		reasonMessageTooLarge:   "filter smtp:[127.0.0.1]:10026",
+		reasonAppNetworkDenied:  "reject",
+		reasonTooManyRecipients: "reject",
+	}
+	if err := validateReasonActions(cfg); err != nil {
+		t.Fatalf("validateReasonActions error: %v", err)
+	}
+	cfg.Policy.MessageLimits.Apps.MaxSize = 10
+
+	sess := &policySession{}
+	fakeIDP := &testutil.FakeIdentityResolver{}
+	rcpt := &policyRequest{State: "RCPT", Instance: "1.1", SASLMethod: "plain", SASLUser: "myapp", Sender: "nope@example.com", Recipient: "x@remote.net"}
+	if got := sess.decide(cfg, db, fakeIDP, rcpt); got != "HOLD Sender not owned by authenticated user" {
+		t.Fatalf("expected HOLD, got %q", got)
+	}
+	data := &policyRequest{State: "DATA", Instance: "1.1", QueueID: "4ABC", SASLMethod: "plain", SASLUser: "myapp", Sender: "nope@example.com", RecipientCount: 1}
+	if got := sess.decide(cfg, db, fakeIDP, data); got != "DUNNO" {
+		t.Fatalf("expected DUNNO at DATA, got %q", got)
+	}
+	eom := &policyRequest{State: "END-OF-MESSAGE", Instance: "1.2", QueueID: "4ABD", SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@example.com", RecipientCount: 1, Size: 100}
+	if got := sess.decide(cfg, db, fakeIDP, eom); got != "FILTER smtp:[127.0.0.1]:10026" {
+		t.Fatalf("expected FILTER, got %q", got)
+	}
+
+	var held []string
+	rows, err := sqlDB.Query(`SELECT queue_id || ' ' || action || ' ' || reason FROM held_messages ORDER BY id`)
+	if err != nil {
+		t.Fatalf("query held_messages: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			t.Fatalf("scan held_messages: %v", err)
+		}
+		held = append(held, h)
+	}
+	if strings.Join(held, ",") != "4ABC hold sender_not_owned,4ABD filter message_too_large" {
+		t.Fatalf("unexpected held messages: %v", held)
+	}
+}
+
+func TestHeldMessageQueueIDFilledLater(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertApp(t, sqlDB, "myapp", true)
+
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.ReasonActions = map[string]string{reasonSenderNotOwned: "hold"}
+	if err := validateReasonActions(cfg); err != nil {
+		t.Fatalf("validateReasonActions error: %v", err)
+	}
+
+	sess := &policySession{}
+	fakeIDP := &testutil.FakeIdentityResolver{}
+	// No queue id at RCPT, as with smtpd_delay_open_until_valid_rcpt = yes
+	for _, r := range []*policyRequest{
+		{State: "RCPT", Instance: "2.1", SASLMethod: "plain", SASLUser: "myapp", Sender: "nope@example.com", Recipient: "a@remote.net"},
+		{State: "RCPT", Instance: "2.1", SASLMethod: "plain", SASLUser: "myapp", Sender: "nope@example.com", Recipient: "b@remote.net"},
+		{State: "RCPT", Instance: "2.2", SASLMethod: "plain", SASLUser: "myapp", Sender: "nope@example.com", Recipient: "c@remote.net"},
+		{State: "END-OF-MESSAGE", Instance: "2.2", QueueID: "5DEF", SASLMethod: "plain", SASLUser: "myapp", Sender: "nope@example.com", RecipientCount: 1},
+	} {
+		sess.decide(cfg, db, fakeIDP, r)
+	}
+
+	var held []string
+	rows, err := sqlDB.Query(`SELECT instance || ' ' || queue_id || ' ' || recipient FROM held_messages ORDER BY id`)
+	if err != nil {
+		t.Fatalf("query held_messages: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			t.Fatalf("scan held_messages: %v", err)
+		}
+		held = append(held, h)
+	}
+	want := "2.1  a@remote.net,2.1  b@remote.net,2.2 5DEF c@remote.net"
+	if strings.Join(held, ",") != want {
+		t.Fatalf("unexpected held messages: %v", held)
+	}
+}
+
+func TestValidateReasonActionsErrors(t *testing.T) {
+	cases := map[string]map[string]string{
+		"unknown reason":   {"nope": "hold"},
+		"unknown action":   {reasonNoSuchUser: "discard"},
+		"filter no target": {reasonNoSuchUser: "filter"},
+		"filter bad":       {reasonNoSuchUser: "filter not-a-nexthop"},
+	}
+	for name, actions := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Policy.ReasonActions = actions
+			if err := validateReasonActions(cfg); err == nil {
+				t.Fatalf("expected error for %v", actions)
+			}
+		})
+	}
+}
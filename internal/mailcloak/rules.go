@@ -0,0 +1,145 @@
+package mailcloak
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Outcome of the configured rules for a request
+type ruleResult struct {
+	action   string // reply of the first matching reject/defer/hold rule
+	accepted bool   // an accept rule matched: skip the built-in checks
+	prepend  string // header of the first matching prepend rule
+}
+
+// Evaluates the rules in order. The first accept, reject, defer or hold
+// rule that matches ends the evaluation, prepend rules only add a header
+// to an otherwise accepted request.
+func evaluateRules(cfg *Config, idp IdentityResolver, req *policyRequest) ruleResult {
+	var res ruleResult
+	if len(cfg.Policy.Rules) == 0 {
+		return res
+	}
+
+	// Group membership is only looked up once, and only if a rule needs it
+	var groups []string
+	var groupsErr error
+	groupsLoaded := false
+	loadGroups := func() ([]string, error) {
+		if !groupsLoaded {
+			groupsLoaded = true
+			groups, groupsErr = userGroups(idp, req)
+		}
+		return groups, groupsErr
+	}
+
+	for i := range cfg.Policy.Rules {
+		r := &cfg.Policy.Rules[i]
+		matched, err := r.Match.matches(req, loadGroups)
+		if err != nil {
+			log.Printf("policy rule %s: idp group lookup error for %s: %v", r.Name, req.SASLUser, err)
+			if failOpen(cfg, req.SenderDomain, req.RecipientDomain) {
+				continue
+			}
+			res.action = reply(cfg, req, reasonLookupFailure)
+			return res
+		}
+		if !matched {
+			continue
+		}
+
+		log.Printf("policy rule matched: rule=%s action=%s state=%s sasl=%s", r.Name, r.Action, req.State, req.SASLUser)
+		if r.Action != "prepend" && r.Action != "accept" {
+			req.Reason = "rule:" + r.Name
+		}
+		switch r.Action {
+		case "prepend":
+			if res.prepend == "" {
+				res.prepend = r.Header
+			}
+			continue
+		case "accept":
+			res.accepted = true
+		case "reject", "defer":
+			res.action = r.Code + " " + r.Text
+		case "hold":
+			res.action = "HOLD " + r.Text
+		}
+		return res
+	}
+	return res
+}
+
+// Groups of an OIDC authenticated user, nil for anyone else
+func userGroups(idp IdentityResolver, req *policyRequest) ([]string, error) {
+	if req.SASLUser == "" || !isUserAuth(req.SASLMethod) {
+		return nil, nil
+	}
+	gr, ok := idp.(GroupResolver)
+	if !ok {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return gr.UserGroups(ctx, req.SASLUser)
+}
+
+func (m *RuleMatch) matches(req *policyRequest, groups func() ([]string, error)) (bool, error) {
+	if len(m.ProtocolState) > 0 && !slices.Contains(m.ProtocolState, req.State) {
+		return false, nil
+	}
+	if len(m.SASLMethod) > 0 {
+		method := req.SASLMethod
+		if method == "" {
+			method = "none"
+		}
+		if !slices.Contains(m.SASLMethod, method) {
+			return false, nil
+		}
+	}
+	if len(m.networks) > 0 && !addrInNetworks(req.ClientAddress, m.networks) {
+		return false, nil
+	}
+	if len(m.SenderDomain) > 0 {
+		domain, _ := domainFromEmail(req.Sender)
+		if !slices.Contains(m.SenderDomain, domain) {
+			return false, nil
+		}
+	}
+	if len(m.RecipientDomain) > 0 {
+		domain, _ := domainFromEmail(req.Recipient)
+		if !slices.Contains(m.RecipientDomain, domain) {
+			return false, nil
+		}
+	}
+	if len(m.IDPGroup) > 0 {
+		userGroups, err := groups()
+		if err != nil {
+			return false, err
+		}
+		if !slices.ContainsFunc(userGroups, func(g string) bool {
+			return slices.ContainsFunc(m.IDPGroup, func(want string) bool { return strings.EqualFold(g, want) })
+		}) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func addrInNetworks(addr string, networks []netip.Prefix) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package mailcloak
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"mailcloak/internal/mailcloak/testutil"
+)
+
+func testRulesConfig(t *testing.T, mode string, rules ...PolicyRule) *Config {
+	t.Helper()
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.RulesMode = mode
+	cfg.Policy.Rules = rules
+	if err := validatePolicyRules(cfg); err != nil {
+		t.Fatalf("validatePolicyRules error: %v", err)
+	}
+	return cfg
+}
+
+func TestPolicyRules(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser:    map[string]string{"alice": "alice@example.com", "bob": "bob@example.com"},
+		EmailExistsSet: map[string]bool{"alice@example.com": true},
+		GroupsByUser:   map[string][]string{"alice": {"Staff", "mail-admins"}},
+	}
+
+	rules := []PolicyRule{
+		{
+			Name:   "block-net",
+			Match:  RuleMatch{ClientAddress: []string{"203.0.113.0/24", "2001:db8::/32"}},
+			Action: "reject",
+			Code:   "554 5.7.1",
+			Text:   "Go away",
+		},
+		{
+			Name:   "slow-down",
+			Match:  RuleMatch{ProtocolState: []string{"rcpt"}, RecipientDomain: []string{"slow.example"}},
+			Action: "defer",
+		},
+		{
+			Name:   "trusted-relay",
+			Match:  RuleMatch{SASLMethod: []string{"none"}, ClientAddress: []string{"192.0.2.10"}},
+			Action: "accept",
+		},
+		{
+			Name:   "admins",
+			Match:  RuleMatch{IDPGroup: []string{"MAIL-ADMINS"}},
+			Action: "prepend",
+			Header: "X-Mailcloak-Admin: yes",
+		},
+		{
+			Name:   "review-apps",
+			Match:  RuleMatch{SASLMethod: []string{"plain", "login"}, SenderDomain: []string{"example.com"}},
+			Action: "hold",
+		},
+	}
+	cfg := testRulesConfig(t, "", rules...)
+
+	cases := []struct {
+		name   string
+		req    *policyRequest
+		expect string
+	}{
+		{
+			name:   "rejected network",
+			req:    &policyRequest{State: "RCPT", ClientAddress: "203.0.113.7", Sender: "user@other.com", Recipient: "alice@example.com"},
+			expect: "554 5.7.1 Go away",
+		},
+		{
+			name:   "rejected ipv6 network",
+			req:    &policyRequest{State: "MAIL", ClientAddress: "2001:db8::25", Sender: "user@other.com"},
+			expect: "554 5.7.1 Go away",
+		},
+		{
+			name:   "deferred recipient domain",
+			req:    &policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "bob", Sender: "bob@example.com", Recipient: "x@slow.example"},
+			expect: "450 4.7.1 Deferred by policy rule slow-down",
+		},
+		{
+			name:   "accept rule skips built-in checks",
+			req:    &policyRequest{State: "RCPT", ClientAddress: "192.0.2.10", Sender: "alice@example.com", Recipient: "a@other.com"},
+			expect: "DUNNO",
+		},
+		{
+			name:   "built-in checks without matching rule",
+			req:    &policyRequest{State: "RCPT", ClientAddress: "192.0.2.11", Sender: "alice@example.com", Recipient: "a@other.com"},
+			expect: "550 5.7.1 Recipient domain not local",
+		},
+		{
+			name:   "prepend for idp group",
+			req:    &policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice@example.com", Recipient: "a@other.com"},
+			expect: "PREPEND X-Mailcloak-Admin: yes",
+		},
+		{
+			name:   "prepend does not override built-in rejection",
+			req:    &policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "bob@example.com", Recipient: "a@other.com"},
+			expect: "553 5.7.1 Sender not owned by authenticated user",
+		},
+		{
+			name:   "hold app mail",
+			req:    &policyRequest{State: "RCPT", SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@example.com", Recipient: "a@other.com"},
+			expect: "HOLD held by policy rule review-apps",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sess := &policySession{}
+			if got := sess.decide(cfg, db, fakeIDP, tc.req); got != tc.expect {
+				t.Fatalf("expected %q, got %q", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestPolicyRulePrependOncePerMessage(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailByUser:  map[string]string{"alice": "alice@example.com"},
+		GroupsByUser: map[string][]string{"alice": {"mail-admins"}},
+	}
+
+	cfg := testRulesConfig(t, "", PolicyRule{
+		Name:   "admins",
+		Match:  RuleMatch{IDPGroup: []string{"mail-admins"}},
+		Action: "prepend",
+		Header: "X-Mailcloak-Admin: yes",
+	})
+	cfg.Policy.PrependHeaders.Enabled = true
+	cfg.Policy.PrependHeaders.UserHeader = "X-Mailcloak-Authenticated-User"
+	sess := &policySession{}
+
+	rcpt := func(instance, recipient string) *policyRequest {
+		return &policyRequest{State: "RCPT", Instance: instance, SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice@example.com", Recipient: recipient}
+	}
+	steps := []struct {
+		name   string
+		req    *policyRequest
+		expect string
+	}{
+		{name: "first recipient", req: rcpt("1", "a@other.com"), expect: "PREPEND X-Mailcloak-Authenticated-User: alice"},
+		{name: "second recipient", req: rcpt("1", "b@other.com"), expect: "PREPEND X-Mailcloak-Admin: yes"},
+		{name: "third recipient", req: rcpt("1", "c@other.com"), expect: "DUNNO"},
+		{name: "end of message", req: &policyRequest{State: "END-OF-MESSAGE", Instance: "1", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice@example.com", RecipientCount: 3}, expect: "DUNNO"},
+		{name: "next message", req: rcpt("2", "a@other.com"), expect: "PREPEND X-Mailcloak-Authenticated-User: alice"},
+		{name: "next message data", req: &policyRequest{State: "DATA", Instance: "2", SASLMethod: "xoauth2", SASLUser: "alice", Sender: "alice@example.com"}, expect: "PREPEND X-Mailcloak-Admin: yes"},
+	}
+	for _, step := range steps {
+		if got := sess.decide(cfg, db, fakeIDP, step.req); got != step.expect {
+			t.Fatalf("%s: expected %q, got %q", step.name, step.expect, got)
+		}
+	}
+}
+
+func TestPolicyRulesInsteadMode(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+
+	cfg := testRulesConfig(t, "instead", PolicyRule{
+		Match:  RuleMatch{RecipientDomain: []string{"blocked.example"}},
+		Action: "reject",
+	})
+	sess := &policySession{}
+	fakeIDP := &testutil.FakeIdentityResolver{}
+
+	// Would be rejected by the built-in checks (relay)
+	req := &policyRequest{State: "RCPT", Sender: "user@other.com", Recipient: "a@other.com"}
+	if got := sess.decide(cfg, db, fakeIDP, req); got != "DUNNO" {
+		t.Fatalf("expected built-in checks to be skipped, got %q", got)
+	}
+
+	req = &policyRequest{State: "RCPT", Sender: "user@other.com", Recipient: "a@blocked.example"}
+	if got := sess.decide(cfg, db, fakeIDP, req); got != "550 5.7.1 Rejected by policy rule rule-1" {
+		t.Fatalf("expected rule rejection, got %q", got)
+	}
+}
+
+func TestPolicyRulesGroupLookupError(t *testing.T) {
+	cfg := testRulesConfig(t, "", PolicyRule{
+		Match:  RuleMatch{IDPGroup: []string{"mail-admins"}},
+		Action: "reject",
+	})
+	fakeIDP := &testutil.FakeIdentityResolver{UserGroupsErr: errors.New("idp down")}
+	req := &policyRequest{State: "RCPT", SASLMethod: "xoauth2", SASLUser: "alice"}
+
+	if got := evaluateRules(cfg, fakeIDP, req); got.action != "451 4.3.0 Temporary authentication/lookup failure" {
+		t.Fatalf("expected tempfail, got %+v", got)
+	}
+
+	cfg.Policy.IDPFailureMode = "dunno"
+	if got := evaluateRules(cfg, fakeIDP, req); got != (ruleResult{}) {
+		t.Fatalf("expected rule to be skipped in dunno mode, got %+v", got)
+	}
+
+	// Groups are never looked up for apps
+	req = &policyRequest{State: "RCPT", SASLMethod: "plain", SASLUser: "myapp"}
+	if got := evaluateRules(cfg, fakeIDP, req); got != (ruleResult{}) {
+		t.Fatalf("expected no match for apps, got %+v", got)
+	}
+}
+
+func TestValidatePolicyRulesErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		mode    string
+		rule    PolicyRule
+		wantErr string
+	}{
+		{name: "bad mode", mode: "after", rule: PolicyRule{Action: "accept"}, wantErr: "unsupported policy.rules_mode"},
+		{name: "bad action", rule: PolicyRule{Action: "drop"}, wantErr: "unsupported action"},
+		{name: "reject with 4xx", rule: PolicyRule{Action: "reject", Code: "450 4.7.1"}, wantErr: "reject code must look like"},
+		{name: "defer with 5xx", rule: PolicyRule{Action: "defer", Code: "550 5.7.1"}, wantErr: "defer code must look like"},
+		{name: "bad network", rule: PolicyRule{Action: "accept", Match: RuleMatch{ClientAddress: []string{"10.0.0.0/33"}}}, wantErr: "invalid network"},
+		{name: "bad state", rule: PolicyRule{Action: "accept", Match: RuleMatch{ProtocolState: []string{"QUIT"}}}, wantErr: "unknown protocol_state"},
+		{name: "bad header", rule: PolicyRule{Action: "prepend", Header: "no colon"}, wantErr: "prepend header must look like"},
+		{name: "multi-line text", rule: PolicyRule{Action: "hold", Text: "a\nb"}, wantErr: "single line"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testPolicyConfig("tempfail")
+			cfg.Policy.RulesMode = tc.mode
+			cfg.Policy.Rules = []PolicyRule{tc.rule}
+			err := validatePolicyRules(cfg)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -74,7 +74,7 @@ func Start(ctx context.Context, cfg *Config) (*Service, error) {
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		if err := ServeSocketmap(ctx, s.db, s.socketmapListener); err != nil {
+		if err := ServeSocketmap(ctx, cfg, s.db, idp, s.socketmapListener); err != nil {
 			if !isExpectedServeErr(ctx, err) {
 				s.handleServeFailure("socketmap", err)
 			}
@@ -92,6 +92,10 @@ func Start(ctx context.Context, cfg *Config) (*Service, error) {
 		}
 	}()
 
+	// Expiry warnings and greylist cleanup, not tracked by wg: they stop with the service
+	go watchAppExpiry(ctx, cfg, s.db, s.done)
+	go watchGreylistExpiry(ctx, cfg, s.db, s.done)
+
 	// Shutdown watcher
 	go func() {
 		<-ctx.Done()
@@ -122,6 +126,9 @@ func (s *Service) Close() error {
 				err = e
 			}
 		}
+		log.Printf("policy connections: %s", &PolicyConnStats)
+		log.Printf("socketmap connections: %s", &SocketmapConnStats)
+		log.Printf("policy monitor would-be rejections: %s", &PolicyMonitorStats)
 	})
 	return err
 }
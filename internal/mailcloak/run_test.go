@@ -3,12 +3,14 @@ package mailcloak
 import (
 	"context"
 	"errors"
+	"io"
 	"net"
-	"os"
 	"os/user"
 	"path/filepath"
 	"testing"
 	"time"
+
+	"mailcloak/internal/mailcloak/testutil"
 )
 
 type acceptStep struct {
@@ -82,10 +84,7 @@ func testConfig(t *testing.T, dir string) *Config {
 		}{
 			Path: filepath.Join(dir, "state.db"),
 		},
-		Policy: struct {
-			IDPFailureMode      string `yaml:"idp_failure_mode"`
-			KeycloakFailureMode string `yaml:"keycloak_failure_mode"`
-		}{
+		Policy: PolicyConfig{
 			IDPFailureMode: "tempfail",
 		},
 		Sockets: struct {
@@ -107,9 +106,7 @@ func testConfig(t *testing.T, dir string) *Config {
 func TestStartShutdown(t *testing.T) {
 	dir := t.TempDir()
 	cfg := testConfig(t, dir)
-	if err := os.WriteFile(cfg.SQLite.Path, []byte{}, 0o600); err != nil {
-		t.Fatalf("write db: %v", err)
-	}
+	testutil.InitSQLiteFile(t, cfg.SQLite.Path)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -134,9 +131,7 @@ func TestStartShutdown(t *testing.T) {
 func TestServiceCloseDoesNotCloseSQLite(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "state.db")
-	if err := os.WriteFile(path, []byte{}, 0o600); err != nil {
-		t.Fatalf("write db: %v", err)
-	}
+	testutil.InitSQLiteFile(t, path)
 
 	db, err := OpenMailcloakDB(path)
 	if err != nil {
@@ -164,9 +159,7 @@ func TestServiceCloseDoesNotCloseSQLite(t *testing.T) {
 func TestServiceCloseDBClosesSQLite(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "state.db")
-	if err := os.WriteFile(path, []byte{}, 0o600); err != nil {
-		t.Fatalf("write db: %v", err)
-	}
+	testutil.InitSQLiteFile(t, path)
 
 	db, err := OpenMailcloakDB(path)
 	if err != nil {
@@ -190,9 +183,7 @@ func TestStartPolicyListenerError(t *testing.T) {
 	dir := t.TempDir()
 	cfg := testConfig(t, dir)
 	cfg.Sockets.PolicySocket = filepath.Join(dir, "missing", "policy.sock")
-	if err := os.WriteFile(cfg.SQLite.Path, []byte{}, 0o600); err != nil {
-		t.Fatalf("write db: %v", err)
-	}
+	testutil.InitSQLiteFile(t, cfg.SQLite.Path)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -206,9 +197,7 @@ func TestStartSocketmapListenerErrorClosesPolicy(t *testing.T) {
 	dir := t.TempDir()
 	cfg := testConfig(t, dir)
 	cfg.Sockets.SocketmapSocket = filepath.Join(dir, "missing", "socketmap.sock")
-	if err := os.WriteFile(cfg.SQLite.Path, []byte{}, 0o600); err != nil {
-		t.Fatalf("write db: %v", err)
-	}
+	testutil.InitSQLiteFile(t, cfg.SQLite.Path)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -273,7 +262,7 @@ func TestServeListenerRetriesTemporaryAcceptErrors(t *testing.T) {
 	handled := make(chan struct{})
 	errCh := make(chan error, 1)
 	go func() {
-		errCh <- serveListener(ctx, "test-listener", l, func(conn net.Conn) {
+		errCh <- serveListener(ctx, "test-listener", l, ServerConfig{}, &ConnStats{}, func(conn net.Conn) {
 			defer conn.Close()
 			close(handled)
 			cancel()
@@ -304,7 +293,7 @@ func TestServeListenerReturnsPermanentAcceptError(t *testing.T) {
 		},
 	}
 
-	err := serveListener(context.Background(), "test-listener", l, func(conn net.Conn) {
+	err := serveListener(context.Background(), "test-listener", l, ServerConfig{}, &ConnStats{}, func(conn net.Conn) {
 		t.Fatal("handler should not be called")
 	})
 	if !errors.Is(err, wantErr) {
@@ -312,6 +301,79 @@ func TestServeListenerReturnsPermanentAcceptError(t *testing.T) {
 	}
 }
 
+func TestServeListenerRefusesConnectionsOverLimit(t *testing.T) {
+	firstServer, firstClient := net.Pipe()
+	defer firstClient.Close()
+	secondServer, secondClient := net.Pipe()
+	defer secondClient.Close()
+
+	l := &stubListener{
+		steps: []acceptStep{
+			{conn: firstServer},
+			{conn: secondServer},
+		},
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	handled := make(chan net.Conn, 2)
+
+	stats := &ConnStats{}
+	srv := ServerConfig{MaxConnections: 1}
+	err := serveListener(context.Background(), "test-listener", l, srv, stats, func(conn net.Conn) {
+		defer conn.Close()
+		handled <- conn
+		<-release
+	})
+	if err != nil {
+		t.Fatalf("serveListener returned unexpected error: %v", err)
+	}
+
+	select {
+	case conn := <-handled:
+		if conn != firstServer {
+			t.Fatal("expected first connection to be handled")
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatal("first connection was not handled")
+	}
+
+	_ = secondClient.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+	if _, err := secondClient.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected refused connection to be closed, got %v", err)
+	}
+
+	if got := stats.Accepted.Load(); got != 2 {
+		t.Fatalf("expected 2 accepted connections, got %d", got)
+	}
+	if got := stats.Refused.Load(); got != 1 {
+		t.Fatalf("expected 1 refused connection, got %d", got)
+	}
+	if got := stats.Active.Load(); got != 1 {
+		t.Fatalf("expected 1 active connection, got %d", got)
+	}
+}
+
+func TestAcquireConnSlotWaitsForRelease(t *testing.T) {
+	slots := make(chan struct{}, 1)
+	slots <- struct{}{}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-slots
+	}()
+
+	if !acquireConnSlot(context.Background(), slots, time.Second) {
+		t.Fatal("expected slot to be acquired once released")
+	}
+	if acquireConnSlot(context.Background(), slots, 0) {
+		t.Fatal("expected full slots to be refused without queue timeout")
+	}
+	if !acquireConnSlot(context.Background(), nil, 0) {
+		t.Fatal("expected unlimited slots to always be acquired")
+	}
+}
+
 func TestHandleServeFailureClosesService(t *testing.T) {
 	policyListener, err := net.Listen("unix", filepath.Join(t.TempDir(), "policy.sock"))
 	if err != nil {
@@ -346,9 +408,7 @@ func TestHandleServeFailureClosesService(t *testing.T) {
 func TestShutdownDoesNotWaitForActiveSocketmapConnections(t *testing.T) {
 	dir := t.TempDir()
 	cfg := testConfig(t, dir)
-	if err := os.WriteFile(cfg.SQLite.Path, []byte{}, 0o600); err != nil {
-		t.Fatalf("write db: %v", err)
-	}
+	testutil.InitSQLiteFile(t, cfg.SQLite.Path)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
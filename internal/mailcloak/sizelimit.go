@@ -0,0 +1,95 @@
+package mailcloak
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Optionally implemented by identity providers exposing user attributes
+type AttributeResolver interface {
+	UserAttribute(ctx context.Context, user, name string) (string, bool, error)
+}
+
+// Message size limit of an authenticated submission, the most specific
+// setting winning: the user (user_limits) or app (apps), the IdP attribute
+// named by policy.size_limit_attribute, the sender domain, then
+// policy.message_limits. 0 means unlimited.
+func messageSizeLimit(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest) (int64, error) {
+	var limit sql.NullInt64
+	var err error
+	switch {
+	case isUserAuth(req.SASLMethod):
+		if limit, err = db.UserMaxMessageSize(req.SASLUser); err != nil || limit.Valid {
+			return limit.Int64, err
+		}
+		if limit, err = idpSizeLimit(cfg, idp, req.SASLUser); err != nil || limit.Valid {
+			return limit.Int64, err
+		}
+	case isAppAuth(req.SASLMethod):
+		if limit, err = db.AppMaxMessageSize(req.SASLUser); err != nil || limit.Valid {
+			return limit.Int64, err
+		}
+	default:
+		return 0, nil
+	}
+
+	if domain, ok := domainFromEmail(req.Sender); ok {
+		if limit, err = db.DomainMaxMessageSize(domain); err != nil || limit.Valid {
+			return limit.Int64, err
+		}
+	}
+
+	if isAppAuth(req.SASLMethod) {
+		return cfg.Policy.MessageLimits.Apps.MaxSize, nil
+	}
+	return cfg.Policy.MessageLimits.Users.MaxSize, nil
+}
+
+// Size limit from the IdP attribute, if configured and set. Values that
+// are not a number of bytes are ignored.
+func idpSizeLimit(cfg *Config, idp IdentityResolver, user string) (sql.NullInt64, error) {
+	name := cfg.Policy.SizeLimitAttribute
+	if name == "" {
+		return sql.NullInt64{}, nil
+	}
+	ar, ok := idp.(AttributeResolver)
+	if !ok {
+		return sql.NullInt64{}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	val, ok, err := ar.UserAttribute(ctx, user, name)
+	if err != nil || !ok {
+		return sql.NullInt64{}, err
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || n < 0 {
+		log.Printf("idp attribute %s of %s: ignoring invalid size %q", name, user, val)
+		return sql.NullInt64{}, nil
+	}
+	return sql.NullInt64{Int64: n, Valid: true}, nil
+}
+
+// Checks the declared size at MAIL, or the actual size at END-OF-MESSAGE,
+// against the size limit of the submitting user or app
+func sizePolicy(cfg *Config, db *MailcloakDB, idp IdentityResolver, req *policyRequest) string {
+	if req.Size <= 0 || req.SASLUser == "" {
+		return "DUNNO"
+	}
+	limit, err := messageSizeLimit(cfg, db, idp, req)
+	if err != nil {
+		log.Printf("size limit lookup error for %s: %v", req.SASLUser, err)
+		if failOpen(cfg, req.SenderDomain, req.RecipientDomain) {
+			return "DUNNO"
+		}
+		return reply(cfg, req, reasonLookupFailure)
+	}
+	if limit > 0 && req.Size > limit {
+		log.Printf("policy message limit: sasl=%s size=%d max=%d", req.SASLUser, req.Size, limit)
+		return reply(cfg, req, reasonMessageTooLarge)
+	}
+	return "DUNNO"
+}
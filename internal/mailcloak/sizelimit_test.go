@@ -0,0 +1,94 @@
+package mailcloak
+
+import (
+	"testing"
+
+	"mailcloak/internal/mailcloak/testutil"
+)
+
+func TestMessageSizeLimitPrecedence(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertDomain(t, sqlDB, "big.example", true)
+	testutil.SetMaxMessageSize(t, sqlDB, "domains", "example.com", 2000)
+	testutil.SetMaxMessageSize(t, sqlDB, "user_limits", "alice", 5000)
+	testutil.SetMaxMessageSize(t, sqlDB, "user_limits", "nolimit", 0)
+	testutil.InsertApp(t, sqlDB, "small-app", true)
+	testutil.SetMaxMessageSize(t, sqlDB, "apps", "small-app", 100)
+	testutil.InsertApp(t, sqlDB, "other-app", true)
+
+	fakeIDP := &testutil.FakeIdentityResolver{
+		AttributesByUser: map[string]map[string]string{
+			"alice": {"mailMaxSize": "9"},
+			"bob":   {"mailMaxSize": "3000"},
+			"carol": {"mailMaxSize": "lots"},
+		},
+	}
+	cfg := testPolicyConfig("tempfail")
+	cfg.Policy.SizeLimitAttribute = "mailMaxSize"
+	cfg.Policy.MessageLimits.Users.MaxSize = 1000
+	cfg.Policy.MessageLimits.Apps.MaxSize = 500
+
+	cases := []struct {
+		name   string
+		method string
+		user   string
+		sender string
+		want   int64
+	}{
+		{name: "user table wins", method: "xoauth2", user: "alice", sender: "alice@example.com", want: 5000},
+		{name: "user table unlimited", method: "xoauth2", user: "nolimit", sender: "nolimit@example.com", want: 0},
+		{name: "idp attribute", method: "xoauth2", user: "bob", sender: "bob@example.com", want: 3000},
+		{name: "invalid attribute falls back to domain", method: "xoauth2", user: "carol", sender: "carol@example.com", want: 2000},
+		{name: "global user default", method: "xoauth2", user: "dave", sender: "dave@big.example", want: 1000},
+		{name: "app override", method: "plain", user: "small-app", sender: "app@big.example", want: 100},
+		{name: "app domain", method: "plain", user: "other-app", sender: "app@example.com", want: 2000},
+		{name: "global app default", method: "login", user: "other-app", sender: "app@big.example", want: 500},
+		{name: "unauthenticated", method: "", user: "", sender: "x@example.com", want: 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &policyRequest{SASLMethod: tc.method, SASLUser: tc.user, Sender: tc.sender}
+			got, err := messageSizeLimit(cfg, db, fakeIDP, req)
+			if err != nil {
+				t.Fatalf("messageSizeLimit error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPolicySessionMailChecksDeclaredSize(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertApp(t, sqlDB, "myapp", true)
+	testutil.InsertAppFrom(t, sqlDB, "myapp", "myapp@example.com", true)
+	testutil.SetMaxMessageSize(t, sqlDB, "apps", "myapp", 1000)
+
+	cfg := testPolicyConfig("tempfail")
+	fakeIDP := &testutil.FakeIdentityResolver{}
+	sess := &policySession{}
+
+	mail := &policyRequest{State: "MAIL", Instance: "1.1", SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@example.com", Size: 1001}
+	if got := sess.decide(cfg, db, fakeIDP, mail); got != "552 5.3.4 Message size exceeds limit" {
+		t.Fatalf("expected declared size to be rejected, got %q", got)
+	}
+
+	mail = &policyRequest{State: "MAIL", Instance: "1.2", SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@example.com"}
+	if got := sess.decide(cfg, db, fakeIDP, mail); got != "DUNNO" {
+		t.Fatalf("expected MAIL without SIZE to pass, got %q", got)
+	}
+
+	eom := &policyRequest{State: "END-OF-MESSAGE", Instance: "1.2", SASLMethod: "plain", SASLUser: "myapp", Sender: "myapp@example.com", RecipientCount: 1, Size: 5000}
+	if got := sess.decide(cfg, db, fakeIDP, eom); got != "552 5.3.4 Message size exceeds limit" {
+		t.Fatalf("expected actual size to be rejected, got %q", got)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func OpenSocketmapListener(cfg *Config) (net.Listener, error) {
@@ -32,29 +33,48 @@ func OpenSocketmapListener(cfg *Config) (net.Listener, error) {
 	return l, nil
 }
 
-func ServeSocketmap(ctx context.Context, db *MailcloakDB, l net.Listener) error {
-	return serveListener(ctx, "socketmap", l, func(conn net.Conn) {
-		go handleSocketmapConn(conn, db)
+func ServeSocketmap(ctx context.Context, cfg *Config, db *MailcloakDB, idp IdentityResolver, l net.Listener) error {
+	return serveListener(ctx, "socketmap", l, cfg.Server, &SocketmapConnStats, func(conn net.Conn) {
+		handleSocketmapConn(conn, cfg, db, idp)
 	})
 }
 
-func RunSocketmap(ctx context.Context, cfg *Config, db *MailcloakDB) error {
+func RunSocketmap(ctx context.Context, cfg *Config, db *MailcloakDB, idp IdentityResolver) error {
 	l, err := OpenSocketmapListener(cfg)
 	if err != nil {
 		return err
 	}
-	return ServeSocketmap(ctx, db, l)
+	return ServeSocketmap(ctx, cfg, db, idp, l)
 }
 
 // Postfix socketmap framing: "<len>:<payload>,"
-func handleSocketmapConn(conn net.Conn, db *MailcloakDB) {
+func handleSocketmapConn(conn net.Conn, cfg *Config, db *MailcloakDB, idp IdentityResolver) {
 	defer conn.Close()
 	r := bufio.NewReader(conn)
 
+	// A failed write closes the connection, which ends the read loop below
+	reply := func(payload string) {
+		_ = conn.SetWriteDeadline(deadlineAfter(cfg.Server.writeTimeout()))
+		if err := writeSocketmapFrame(conn, payload); err != nil {
+			if isTimeoutErr(err) {
+				SocketmapConnStats.TimedOut.Add(1)
+			}
+			log.Printf("socketmap write error: %v", err)
+			_ = conn.Close()
+		}
+	}
+
 	for {
-		payload, err := readSocketmapFrame(r)
+		err := waitForRequest(conn, r, cfg.Server)
+		var payload string
+		if err == nil {
+			payload, err = readSocketmapFrame(r)
+		}
 		if err != nil {
-			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			if isTimeoutErr(err) {
+				SocketmapConnStats.TimedOut.Add(1)
+				log.Printf("socketmap connection timeout: %v", err)
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
 				log.Printf("socketmap read error: %v", err)
 			}
 			// normal close
@@ -64,62 +84,120 @@ func handleSocketmapConn(conn net.Conn, db *MailcloakDB) {
 		payload = strings.TrimSpace(payload)
 		if payload == "" {
 			log.Printf("socketmap request: empty payload")
-			_ = writeSocketmapFrame(conn, "NOTFOUND")
+			reply("NOTFOUND")
 			continue
 		}
 
 		parts := strings.SplitN(payload, " ", 2)
 		if len(parts) != 2 {
 			log.Printf("socketmap request: malformed payload=%q", payload)
-			_ = writeSocketmapFrame(conn, "TEMP")
+			reply("TEMP")
 			continue
 		}
 
 		mapName := parts[0]
-		key := strings.ToLower(strings.TrimSpace(parts[1]))
+		key := normalizeEmail(strings.TrimSpace(parts[1]))
 		log.Printf("socketmap request: map=%s key=%s", mapName, key)
 
 		if mapName != "alias" {
 			log.Printf("socketmap decision: map=%s action=NOTFOUND", mapName)
-			_ = writeSocketmapFrame(conn, "NOTFOUND")
+			reply("NOTFOUND")
 			continue
 		}
 
 		domain, ok := domainFromEmail(key)
 		if !ok {
 			log.Printf("socketmap decision: map=alias key=%s action=NOTFOUND (invalid address)", key)
-			_ = writeSocketmapFrame(conn, "NOTFOUND")
+			reply("NOTFOUND")
 			continue
 		}
 		local, err := db.DomainEnabled(domain)
 		if err != nil {
 			log.Printf("socketmap domain lookup error: key=%s err=%v", key, err)
-			_ = writeSocketmapFrame(conn, "TEMP")
+			reply("TEMP")
 			continue
 		}
 		if !local {
+			// Alias domain addresses are rewritten to the domain they map
+			// onto, Postfix then resolves the result again
+			mapped, _, ok, err := db.ResolveAliasDomain(key)
+			if err != nil {
+				log.Printf("socketmap alias domain lookup error: key=%s err=%v", key, err)
+				reply("TEMP")
+				continue
+			}
+			if ok {
+				log.Printf("socketmap decision: map=alias key=%s action=OK %s (alias domain)", key, mapped)
+				reply("OK " + mapped)
+				continue
+			}
 			log.Printf("socketmap decision: map=alias key=%s action=NOTFOUND (other domain)", key)
-			_ = writeSocketmapFrame(conn, "NOTFOUND")
+			reply("NOTFOUND")
 			continue
 		}
 
-		username, ok, err := db.AliasOwner(key)
-		if err != nil {
-			log.Printf("socketmap db error: key=%s err=%v", key, err)
-			_ = writeSocketmapFrame(conn, "TEMP")
+		// The alias as given, then without its extension, which is kept
+		// in the rewrite
+		var username, ext string
+		found, failed := false, false
+		for _, addr := range addressVariants(key, cfg.Policy.RecipientDelimiter) {
+			username, found, err = db.AliasOwner(addr)
+			if err != nil {
+				log.Printf("socketmap db error: key=%s err=%v", key, err)
+				failed = true
+				break
+			}
+			if found {
+				if addr != key {
+					_, ext = splitAddressExtension(key, cfg.Policy.RecipientDelimiter)
+				}
+				break
+			}
+		}
+		if failed {
+			reply("TEMP")
 			continue
 		}
-		if !ok {
+		if !found {
+			username, found, err = catchallTarget(cfg, db, idp, key, domain)
+			if err != nil {
+				log.Printf("socketmap catch-all lookup error: key=%s err=%v", key, err)
+				reply("TEMP")
+				continue
+			}
+		}
+		if !found {
 			log.Printf("socketmap decision: map=alias key=%s action=NOTFOUND", key)
-			_ = writeSocketmapFrame(conn, "NOTFOUND")
+			reply("NOTFOUND")
 			continue
 		}
 
 		// rewrite alias -> username@domain
-		reply := fmt.Sprintf("OK %s@%s", username, domain)
-		log.Printf("socketmap decision: map=alias key=%s action=%s", key, reply)
-		_ = writeSocketmapFrame(conn, reply)
+		rewrite := fmt.Sprintf("OK %s%s@%s", username, ext, domain)
+		log.Printf("socketmap decision: map=alias key=%s action=%s", key, rewrite)
+		reply(rewrite)
+	}
+}
+
+// The domain catch-all user for an address that is neither an alias nor
+// an existing mailbox, which must keep being delivered to its owner
+func catchallTarget(cfg *Config, db *MailcloakDB, idp IdentityResolver, key, domain string) (string, bool, error) {
+	catchall, ok, err := db.DomainCatchall(domain)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	for _, addr := range addressVariants(key, cfg.Policy.RecipientDelimiter) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		exists, err := idp.EmailExists(ctx, addr)
+		cancel()
+		if err != nil {
+			return "", false, err
+		}
+		if exists {
+			return "", false, nil
+		}
 	}
+	return catchall, true, nil
 }
 
 func readSocketmapFrame(r *bufio.Reader) (string, error) {
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"net"
 	"path/filepath"
 	"testing"
@@ -34,6 +35,16 @@ func TestHandleSocketmapConn(t *testing.T) {
 	testutil.InsertDomain(t, db, "disabled.com", false)
 	testutil.InsertAlias(t, db, "alias@example.com", "alice", true)
 	testutil.InsertAlias(t, db, "alias@other-local.com", "alice", true)
+	testutil.InsertAlias(t, db, "odd+one@example.com", "bob", true)
+	testutil.InsertDomain(t, db, "catchall.com", true)
+	testutil.SetDomainCatchall(t, db, "catchall.com", "postmaster")
+	testutil.InsertAlias(t, db, "sales@catchall.com", "carol", true)
+	testutil.InsertAliasDomain(t, db, "example.org", "example.com", false)
+	fakeIDP := &testutil.FakeIdentityResolver{
+		EmailExistsSet: map[string]bool{"dave@catchall.com": true, "postmaster@catchall.com": true},
+	}
+	cfg := &Config{}
+	cfg.Policy.RecipientDelimiter = "+-"
 
 	roundTrip := func(t *testing.T, payload string) string {
 		client, server := net.Pipe()
@@ -41,7 +52,7 @@ func TestHandleSocketmapConn(t *testing.T) {
 
 		done := make(chan struct{})
 		go func() {
-			handleSocketmapConn(server, mailDB)
+			handleSocketmapConn(server, cfg, mailDB, fakeIDP)
 			close(done)
 		}()
 
@@ -64,7 +75,18 @@ func TestHandleSocketmapConn(t *testing.T) {
 	}{
 		{name: "alias found", payload: "alias alias@example.com", expect: "OK alice@example.com"},
 		{name: "alias found other local domain", payload: "alias alias@other-local.com", expect: "OK alice@other-local.com"},
+		{name: "alias extension kept", payload: "alias alias+news@example.com", expect: "OK alice+news@example.com"},
+		{name: "alias other delimiter", payload: "alias alias-lists@example.com", expect: "OK alice-lists@example.com"},
+		{name: "alias with delimiter matched as given", payload: "alias odd+one@example.com", expect: "OK bob@example.com"},
+		{name: "unknown alias with extension", payload: "alias nobody+x@example.com", expect: "NOTFOUND"},
 		{name: "other domain", payload: "alias other@other.com", expect: "NOTFOUND"},
+		{name: "alias domain", payload: "alias alias+x@example.org", expect: "OK alias+x@example.com"},
+		{name: "catch-all unknown address", payload: "alias random@catchall.com", expect: "OK postmaster@catchall.com"},
+		{name: "catch-all keeps aliases", payload: "alias sales@catchall.com", expect: "OK carol@catchall.com"},
+		{name: "catch-all keeps mailboxes", payload: "alias dave@catchall.com", expect: "NOTFOUND"},
+		{name: "catch-all keeps mailbox extensions", payload: "alias dave+x@catchall.com", expect: "NOTFOUND"},
+		{name: "catch-all target", payload: "alias postmaster@catchall.com", expect: "NOTFOUND"},
+		{name: "no catch-all", payload: "alias random@example.com", expect: "NOTFOUND"},
 		{name: "disabled local domain", payload: "alias user@disabled.com", expect: "NOTFOUND"},
 		{name: "wrong map", payload: "virtual alias@example.com", expect: "NOTFOUND"},
 		{name: "empty payload", payload: "", expect: "NOTFOUND"},
@@ -87,7 +109,30 @@ func TestRunSocketmapOpenListenerError(t *testing.T) {
 	db := &MailcloakDB{DB: testutil.NewSQLiteDB(t)}
 	defer db.Close()
 
-	if err := RunSocketmap(context.Background(), cfg, db); err == nil {
+	if err := RunSocketmap(context.Background(), cfg, db, &testutil.FakeIdentityResolver{}); err == nil {
 		t.Fatal("expected listener error")
 	}
 }
+
+func TestSocketmapCatchallIDPError(t *testing.T) {
+	db := testutil.NewSQLiteDB(t)
+	defer db.Close()
+	mailDB := &MailcloakDB{DB: db}
+	testutil.InsertDomain(t, db, "catchall.com", true)
+	testutil.SetDomainCatchall(t, db, "catchall.com", "postmaster")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleSocketmapConn(server, &Config{}, mailDB, &testutil.FakeIdentityResolver{EmailExistsErr: errors.New("idp down")})
+
+	if err := writeSocketmapFrame(client, "alias random@catchall.com"); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := readSocketmapFrame(bufio.NewReader(client))
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp != "TEMP" {
+		t.Fatalf("expected TEMP when the idp is unavailable, got %q", resp)
+	}
+}
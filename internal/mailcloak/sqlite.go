@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
@@ -31,6 +32,10 @@ PRAGMA synchronous=NORMAL;
 		_ = db.Close()
 		return nil, fmt.Errorf("init pragmas: %w", err)
 	}
+	if err := checkSchema(db); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("sqlite db at %s is out of date, run 'mailcloakctl init' to migrate it: %w", path, err)
+	}
 	log.Printf("sqlite: db ready")
 
 	return &MailcloakDB{DB: db}, nil
@@ -38,10 +43,71 @@ PRAGMA synchronous=NORMAL;
 
 func (a *MailcloakDB) Close() error { return a.DB.Close() }
 
+// The tables queried, with the columns added to them after their creation
+// (MIGRATED_COLUMNS in mailcloakctl). A binary upgraded without running
+// "mailcloakctl init" would otherwise fail every request.
+var schemaColumns = []struct {
+	table   string
+	columns []string
+}{
+	{"domains", []string{"catchall_user", "max_message_size", "failure_mode", "policy_mode", "max_recipients", "auth_methods"}},
+	{"aliases", nil},
+	{"alias_domains", nil},
+	{"send_as", nil},
+	{"internal_only_users", nil},
+	{"user_limits", nil},
+	{"apps", []string{
+		"max_messages_per_minute", "max_messages_per_hour", "max_messages_per_day",
+		"max_recipients_per_minute", "max_recipients_per_hour", "max_recipients_per_day",
+		"not_before", "expires_at", "max_message_size",
+	}},
+	{"app_from", []string{"not_before", "expires_at"}},
+	{"app_networks", nil},
+	{"app_certs", nil},
+	{"app_rcpt", nil},
+	{"message_log", nil},
+	{"held_messages", nil},
+	{"rate_events", nil},
+	{"greylist", nil},
+	{"greylist_whitelist", nil},
+}
+
+func checkSchema(db *sql.DB) error {
+	for _, t := range schemaColumns {
+		rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, t.table)
+		if err != nil {
+			return err
+		}
+		existing := map[string]bool{}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			existing[name] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			return fmt.Errorf("missing table %s", t.table)
+		}
+		for _, c := range t.columns {
+			if !existing[c] {
+				return fmt.Errorf("missing column %s.%s", t.table, c)
+			}
+		}
+	}
+	return nil
+}
+
 func (a *MailcloakDB) DomainEnabled(domain string) (bool, error) {
 	var enabled int
 
-	err := a.DB.QueryRow(`SELECT enabled FROM domains WHERE domain_name=?`, strings.ToLower(domain)).Scan(&enabled)
+	err := a.DB.QueryRow(`SELECT enabled FROM domains WHERE domain_name=?`, normalizeDomain(domain)).Scan(&enabled)
 	if err == sql.ErrNoRows {
 		return false, nil
 	}
@@ -64,6 +130,79 @@ func (a *MailcloakDB) DomainFromEmailIsLocal(email string) (bool, error) {
 	return a.DomainEnabled(domain)
 }
 
+// Returns the catch-all user of an enabled domain, ok
+func (a *MailcloakDB) DomainCatchall(domain string) (string, bool, error) {
+	var user sql.NullString
+	err := a.DB.QueryRow(`SELECT catchall_user FROM domains WHERE domain_name=? AND enabled=1`, normalizeDomain(domain)).Scan(&user)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if !user.Valid || user.String == "" {
+		return "", false, nil
+	}
+	return user.String, true, nil
+}
+
+// Policy settings of a domain overriding the global ones, empty or
+// invalid values fall back to the configuration
+type DomainSettings struct {
+	FailureMode   string        // "tempfail" or "dunno"
+	Mode          string        // "enforce" or "monitor"
+	MaxRecipients sql.NullInt64 // per message, 0 = unlimited
+	AuthMethods   []string      // SASL methods allowed for senders of the domain
+}
+
+// Returns the settings of an enabled domain, the zero value for unknown
+// or disabled domains
+func (a *MailcloakDB) DomainSettings(domain string) (DomainSettings, error) {
+	var s DomainSettings
+	var failureMode, mode, authMethods sql.NullString
+	err := a.DB.QueryRow(`
+SELECT failure_mode, policy_mode, max_recipients, auth_methods
+FROM domains
+WHERE domain_name=? AND enabled=1`, normalizeDomain(domain)).Scan(&failureMode, &mode, &s.MaxRecipients, &authMethods)
+	if err == sql.ErrNoRows {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	s.FailureMode, s.Mode = failureMode.String, mode.String
+	for _, m := range strings.Split(authMethods.String, ",") {
+		if m = strings.ToLower(strings.TrimSpace(m)); m != "" {
+			s.AuthMethods = append(s.AuthMethods, m)
+		}
+	}
+	return s, nil
+}
+
+// Maps an address of an enabled alias domain onto its enabled target
+// domain. senders reports whether the mapping also applies to senders.
+func (a *MailcloakDB) ResolveAliasDomain(email string) (mapped string, senders bool, ok bool, err error) {
+	domain, valid := domainFromEmail(email)
+	if !valid {
+		return "", false, false, nil
+	}
+	var target string
+	var mapSenders int
+	err = a.DB.QueryRow(`
+SELECT ad.target_domain_name, ad.map_senders
+FROM alias_domains ad
+JOIN domains d ON d.domain_name = ad.target_domain_name
+WHERE ad.domain_name=? AND ad.enabled=1 AND d.enabled=1`, domain).Scan(&target, &mapSenders)
+	if err == sql.ErrNoRows {
+		return "", false, false, nil
+	}
+	if err != nil {
+		return "", false, false, err
+	}
+	local := email[:strings.LastIndexByte(email, '@')]
+	return local + "@" + target, mapSenders == 1, true, nil
+}
+
 // Returns email owning alias, ok
 func (a *MailcloakDB) AliasOwner(aliasEmail string) (string, bool, error) {
 	var user string
@@ -94,22 +233,391 @@ func (a *MailcloakDB) AliasBelongsTo(aliasEmail, user string) (bool, error) {
 	return enabled == 1, nil
 }
 
-// Returns true if app_id is enabled and sender is allowed for app
+// Reports whether an enabled alias, send-as grant or app sender names the
+// address as given
+func (a *MailcloakDB) SenderAddressClaimed(address string) (bool, error) {
+	var claimed bool
+	err := a.DB.QueryRow(`
+SELECT EXISTS(SELECT 1 FROM aliases WHERE alias_email=? AND enabled=1)
+    OR EXISTS(SELECT 1 FROM send_as WHERE address=? AND enabled=1)
+    OR EXISTS(SELECT 1 FROM app_from WHERE from_addr=? AND enabled=1)`,
+		address, address, address).Scan(&claimed)
+	return claimed, err
+}
+
+// Reports whether a user may only send to local domains
+func (a *MailcloakDB) UserInternalOnly(username string) (bool, error) {
+	var one int
+	err := a.DB.QueryRow(`SELECT 1 FROM internal_only_users WHERE username=? LIMIT 1`,
+		strings.ToLower(username)).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns the enabled app a client certificate, or its public key, is
+// mapped to
+func (a *MailcloakDB) AppForCert(fingerprint, pubkeyFingerprint string) (string, bool, error) {
+	var appID string
+	var notBefore, expiresAt sql.NullInt64
+	err := a.DB.QueryRow(`
+SELECT c.app_id, a.not_before, a.expires_at
+FROM app_certs c
+JOIN apps a ON a.app_id = c.app_id
+WHERE c.enabled=1 AND a.enabled=1 AND c.fingerprint<>'' AND
+      ((c.kind='cert' AND c.fingerprint=?) OR (c.kind='pubkey' AND c.fingerprint=?))
+ORDER BY c.kind LIMIT 1`, normalizeFingerprint(fingerprint), normalizeFingerprint(pubkeyFingerprint)).Scan(
+		&appID, &notBefore, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if !validAt(time.Now().Unix(), notBefore, expiresAt) {
+		log.Printf("app %s is outside of its validity period", appID)
+		return "", false, nil
+	}
+	return appID, true, nil
+}
+
+// Networks an app may submit from, none means any network
+func (a *MailcloakDB) AppNetworks(appID string) ([]string, error) {
+	rows, err := a.DB.Query(`SELECT network FROM app_networks WHERE app_id=? ORDER BY network`, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var networks []string
+	for rows.Next() {
+		var n string
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, rows.Err()
+}
+
+// Recipient patterns an app may send to, none means any recipient
+func (a *MailcloakDB) AppRecipients(appID string) ([]string, error) {
+	rows, err := a.DB.Query(`SELECT pattern FROM app_rcpt WHERE app_id=? AND enabled=1 ORDER BY pattern`, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var patterns []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, rows.Err()
+}
+
+// Users and IdP groups allowed to send as an address
+func (a *MailcloakDB) SendAsGrantees(address string) (users []string, groups []string, err error) {
+	rows, err := a.DB.Query(`SELECT grantee_type, grantee FROM send_as WHERE address=? AND enabled=1`, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, grantee string
+		if err := rows.Scan(&kind, &grantee); err != nil {
+			return nil, nil, err
+		}
+		switch kind {
+		case "user":
+			users = append(users, grantee)
+		case "group":
+			groups = append(groups, grantee)
+		}
+	}
+	return users, groups, rows.Err()
+}
+
+// Returns true if app_id is enabled and sender is allowed for app, both
+// within their validity period (not_before, expires_at)
 func (a *MailcloakDB) AppFromAllowed(appID, fromAddr string) (bool, error) {
 	var appEnabled int
 	var fromEnabled int
+	var appNotBefore, appExpires, fromNotBefore, fromExpires sql.NullInt64
 	err := a.DB.QueryRow(`
-SELECT a.enabled, af.enabled
+SELECT a.enabled, a.not_before, a.expires_at, af.enabled, af.not_before, af.expires_at
 FROM app_from af
 JOIN apps a ON a.app_id = af.app_id
-WHERE af.app_id=? AND af.from_addr=?`, appID, fromAddr).Scan(&appEnabled, &fromEnabled)
+WHERE af.app_id=? AND af.from_addr=?`, appID, fromAddr).Scan(
+		&appEnabled, &appNotBefore, &appExpires, &fromEnabled, &fromNotBefore, &fromExpires)
 	if err == sql.ErrNoRows {
 		return false, nil
 	}
 	if err != nil {
 		return false, err
 	}
-	return appEnabled == 1 && fromEnabled == 1, nil
+	if appEnabled != 1 || fromEnabled != 1 {
+		return false, nil
+	}
+	now := time.Now().Unix()
+	if !validAt(now, appNotBefore, appExpires) {
+		log.Printf("app %s is outside of its validity period", appID)
+		return false, nil
+	}
+	if !validAt(now, fromNotBefore, fromExpires) {
+		log.Printf("app %s: sender %s is outside of its validity period", appID, fromAddr)
+		return false, nil
+	}
+	return true, nil
+}
+
+func validAt(now int64, notBefore, expiresAt sql.NullInt64) bool {
+	if notBefore.Valid && now < notBefore.Int64 {
+		return false
+	}
+	if expiresAt.Valid && now >= expiresAt.Int64 {
+		return false
+	}
+	return true
+}
+
+// An enabled app, or one of its sender addresses, with an expiry date
+type AppExpiry struct {
+	AppID     string
+	FromAddr  string // empty when the app itself expires
+	ExpiresAt time.Time
+}
+
+// Enabled apps and sender addresses expiring before the given time,
+// including those already expired, soonest first
+func (a *MailcloakDB) AppsExpiringBefore(before time.Time) ([]AppExpiry, error) {
+	rows, err := a.DB.Query(`
+SELECT app_id, '', expires_at FROM apps
+WHERE enabled=1 AND expires_at IS NOT NULL AND expires_at < ?
+UNION ALL
+SELECT af.app_id, af.from_addr, af.expires_at FROM app_from af
+JOIN apps a ON a.app_id = af.app_id
+WHERE a.enabled=1 AND af.enabled=1 AND af.expires_at IS NOT NULL AND af.expires_at < ?
+ORDER BY 3, 1, 2`, before.Unix(), before.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []AppExpiry
+	for rows.Next() {
+		var e AppExpiry
+		var ts int64
+		if err := rows.Scan(&e.AppID, &e.FromAddr, &ts); err != nil {
+			return nil, err
+		}
+		e.ExpiresAt = time.Unix(ts, 0)
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// Final accounting for a message accepted at END-OF-MESSAGE
+type MessageRecord struct {
+	QueueID        string
+	SASLMethod     string
+	SASLUser       string
+	Sender         string
+	ClientAddress  string
+	RecipientCount int
+	Size           int64
+}
+
+func (a *MailcloakDB) RecordMessage(rec MessageRecord) error {
+	_, err := a.DB.Exec(`
+INSERT INTO message_log(queue_id, sasl_method, sasl_username, sender, client_address, recipient_count, size, created_at)
+VALUES(?,?,?,?,?,?,?,strftime('%s','now'))`,
+		rec.QueueID, rec.SASLMethod, rec.SASLUser, rec.Sender, rec.ClientAddress, rec.RecipientCount, rec.Size)
+	return err
+}
+
+// Message size limits, NULL when not set for the user, app or domain
+func (a *MailcloakDB) UserMaxMessageSize(username string) (sql.NullInt64, error) {
+	return a.maxMessageSize(`SELECT max_message_size FROM user_limits WHERE username=?`, strings.ToLower(username))
+}
+
+func (a *MailcloakDB) AppMaxMessageSize(appID string) (sql.NullInt64, error) {
+	return a.maxMessageSize(`SELECT max_message_size FROM apps WHERE app_id=?`, appID)
+}
+
+func (a *MailcloakDB) DomainMaxMessageSize(domain string) (sql.NullInt64, error) {
+	return a.maxMessageSize(`SELECT max_message_size FROM domains WHERE domain_name=? AND enabled=1`, normalizeDomain(domain))
+}
+
+func (a *MailcloakDB) maxMessageSize(query, key string) (sql.NullInt64, error) {
+	var limit sql.NullInt64
+	err := a.DB.QueryRow(query, key).Scan(&limit)
+	if err == sql.ErrNoRows {
+		return sql.NullInt64{}, nil
+	}
+	return limit, err
+}
+
+type HeldMessage struct {
+	QueueID       string
+	Instance      string
+	Action        string // "hold" or "filter"
+	Reason        string
+	SASLUser      string
+	Sender        string
+	Recipient     string
+	ClientAddress string
+}
+
+func (a *MailcloakDB) RecordHeldMessage(m HeldMessage) error {
+	_, err := a.DB.Exec(`
+INSERT INTO held_messages(queue_id, instance, action, reason, sasl_username, sender, recipient, client_address, created_at)
+VALUES(?,?,?,?,?,?,?,?,strftime('%s','now'))`,
+		m.QueueID, m.Instance, m.Action, m.Reason, m.SASLUser, m.Sender, m.Recipient, m.ClientAddress)
+	return err
+}
+
+// Sets the queue id of the messages held before it was known: with
+// smtpd_delay_open_until_valid_rcpt Postfix only assigns one after RCPT
+func (a *MailcloakDB) SetHeldQueueID(instance, queueID string) error {
+	_, err := a.DB.Exec(`UPDATE held_messages SET queue_id=? WHERE instance=? AND queue_id=''`, queueID, instance)
+	return err
+}
+
+type AppRateLimits struct {
+	MessagesPerMinute   sql.NullInt64
+	MessagesPerHour     sql.NullInt64
+	MessagesPerDay      sql.NullInt64
+	RecipientsPerMinute sql.NullInt64
+	RecipientsPerHour   sql.NullInt64
+	RecipientsPerDay    sql.NullInt64
+}
+
+// Returns the rate limits overridden for an app; nil fields use the defaults
+func (a *MailcloakDB) AppRateLimits(appID string) (AppRateLimits, error) {
+	var l AppRateLimits
+	err := a.DB.QueryRow(`
+SELECT max_messages_per_minute, max_messages_per_hour, max_messages_per_day,
+       max_recipients_per_minute, max_recipients_per_hour, max_recipients_per_day
+FROM apps WHERE app_id=?`, appID).Scan(
+		&l.MessagesPerMinute, &l.MessagesPerHour, &l.MessagesPerDay,
+		&l.RecipientsPerMinute, &l.RecipientsPerHour, &l.RecipientsPerDay)
+	if err == sql.ErrNoRows {
+		return AppRateLimits{}, nil
+	}
+	return l, err
+}
+
+// Returns messages and recipients sent by user since the given time,
+// and whether the message transaction instance was already counted
+func (a *MailcloakDB) RateUsage(user, instance string, since time.Time) (int, int, bool, error) {
+	var messages, recipients int
+	var seen bool
+	err := a.DB.QueryRow(`
+SELECT COUNT(DISTINCT instance), COUNT(*), COALESCE(SUM(instance=?), 0) > 0
+FROM rate_events
+WHERE sasl_username=? AND created_at>=?`, instance, user, since.Unix()).Scan(&messages, &recipients, &seen)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return messages, recipients, seen, nil
+}
+
+// Records an accepted recipient and drops events older than the largest window
+func (a *MailcloakDB) RecordRateEvent(user, instance, rcpt string, at time.Time) error {
+	if _, err := a.DB.Exec(`
+INSERT OR IGNORE INTO rate_events(sasl_username, instance, recipient, created_at)
+VALUES(?,?,?,?)`, user, instance, rcpt, at.Unix()); err != nil {
+		return err
+	}
+	_, err := a.DB.Exec(`DELETE FROM rate_events WHERE sasl_username=? AND created_at<?`,
+		user, at.Add(-rateEventRetention).Unix())
+	return err
+}
+
+// Refreshes a whitelisted client network and sender seen since the given
+// time, reporting whether it was whitelisted
+func (a *MailcloakDB) GreylistWhitelisted(clientNet, sender string, now, since time.Time) (bool, error) {
+	res, err := a.DB.Exec(`
+UPDATE greylist_whitelist SET last_seen=?
+WHERE client_net=? AND sender=? AND last_seen>=?`, now.Unix(), clientNet, sender, since.Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Records a delivery attempt for a triplet and returns when it was first
+// seen. Triplets first seen before staleBefore start over.
+func (a *MailcloakDB) GreylistTriplet(clientNet, sender, rcpt string, now, staleBefore time.Time) (time.Time, error) {
+	var first int64
+	err := a.DB.QueryRow(`
+INSERT INTO greylist(client_net, sender, recipient, first_seen, last_seen)
+VALUES(?,?,?,?,?)
+ON CONFLICT(client_net, sender, recipient) DO UPDATE SET
+  first_seen = CASE WHEN first_seen<? THEN excluded.first_seen ELSE first_seen END,
+  last_seen = excluded.last_seen
+RETURNING first_seen`, clientNet, sender, rcpt, now.Unix(), now.Unix(), staleBefore.Unix()).Scan(&first)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(first, 0), nil
+}
+
+// Whitelists the client network and sender of a triplet that passed
+func (a *MailcloakDB) GreylistPass(clientNet, sender, rcpt string, now time.Time) error {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(`DELETE FROM greylist WHERE client_net=? AND sender=? AND recipient=?`,
+		clientNet, sender, rcpt); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+INSERT INTO greylist_whitelist(client_net, sender, passed, last_seen)
+VALUES(?,?,1,?)
+ON CONFLICT(client_net, sender) DO UPDATE SET
+  passed = passed + 1,
+  last_seen = excluded.last_seen`, clientNet, sender, now.Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Drops pending triplets first seen before pendingBefore and whitelist
+// entries last seen before whitelistBefore, returning how many were removed
+func (a *MailcloakDB) ExpireGreylist(pendingBefore, whitelistBefore time.Time) (int64, error) {
+	res, err := a.DB.Exec(`DELETE FROM greylist WHERE first_seen<?`, pendingBefore.Unix())
+	if err != nil {
+		return 0, err
+	}
+	pending, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	res, err = a.DB.Exec(`DELETE FROM greylist_whitelist WHERE last_seen<?`, whitelistBefore.Unix())
+	if err != nil {
+		return 0, err
+	}
+	whitelisted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return pending + whitelisted, nil
 }
 
 func ensureDBExists(path string) error {
@@ -1,10 +1,12 @@
 package mailcloak
 
 import (
+	"database/sql"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"mailcloak/internal/mailcloak/testutil"
 )
@@ -155,11 +157,47 @@ func TestDomainEnabled(t *testing.T) {
 	}
 }
 
+func TestResolveAliasDomain(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	testutil.InsertDomain(t, sqlDB, "example.com", true)
+	testutil.InsertDomain(t, sqlDB, "disabled.com", false)
+	testutil.InsertAliasDomain(t, sqlDB, "example.org", "example.com", true)
+	testutil.InsertAliasDomain(t, sqlDB, "example.net", "example.com", false)
+	testutil.InsertAliasDomain(t, sqlDB, "example.de", "disabled.com", true)
+
+	mapped, senders, ok, err := db.ResolveAliasDomain("alice+x@Example.ORG")
+	if err != nil {
+		t.Fatalf("ResolveAliasDomain error: %v", err)
+	}
+	if !ok || !senders || mapped != "alice+x@example.com" {
+		t.Fatalf("unexpected mapping: mapped=%q senders=%v ok=%v", mapped, senders, ok)
+	}
+
+	mapped, senders, ok, err = db.ResolveAliasDomain("alice@example.net")
+	if err != nil {
+		t.Fatalf("ResolveAliasDomain error: %v", err)
+	}
+	if !ok || senders || mapped != "alice@example.com" {
+		t.Fatalf("unexpected mapping: mapped=%q senders=%v ok=%v", mapped, senders, ok)
+	}
+
+	for _, email := range []string{"alice@example.de", "alice@example.com", "not-an-address"} {
+		_, _, ok, err = db.ResolveAliasDomain(email)
+		if err != nil {
+			t.Fatalf("ResolveAliasDomain error: %v", err)
+		}
+		if ok {
+			t.Fatalf("expected no mapping for %s", email)
+		}
+	}
+}
+
 func TestOpenMailcloakDBAndClose(t *testing.T) {
 	dbPath := filepath.Join(t.TempDir(), "mailcloak.db")
-	if err := os.WriteFile(dbPath, []byte{}, 0o600); err != nil {
-		t.Fatalf("write db file: %v", err)
-	}
+	testutil.InitSQLiteFile(t, dbPath)
 
 	db, err := OpenMailcloakDB(dbPath)
 	if err != nil {
@@ -171,6 +209,35 @@ func TestOpenMailcloakDBAndClose(t *testing.T) {
 	}
 }
 
+func TestOpenMailcloakDBOutdatedSchema(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.db")
+	if err := os.WriteFile(empty, []byte{}, 0o600); err != nil {
+		t.Fatalf("write db file: %v", err)
+	}
+	old := filepath.Join(dir, "old.db")
+	testutil.InitSQLiteFile(t, old)
+	sqlDB, err := sql.Open("sqlite", old)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if _, err := sqlDB.Exec(`ALTER TABLE domains DROP COLUMN failure_mode`); err != nil {
+		t.Fatalf("drop column: %v", err)
+	}
+	sqlDB.Close()
+
+	cases := map[string]string{
+		empty: "missing table domains",
+		old:   "missing column domains.failure_mode",
+	}
+	for path, wantErr := range cases {
+		_, err := OpenMailcloakDB(path)
+		if err == nil || !strings.Contains(err.Error(), wantErr) || !strings.Contains(err.Error(), "mailcloakctl init") {
+			t.Fatalf("%s: expected error containing %q, got %v", filepath.Base(path), wantErr, err)
+		}
+	}
+}
+
 func TestEnsureDBExists(t *testing.T) {
 	dir := t.TempDir()
 	existing := filepath.Join(dir, "mailcloak.db")
@@ -209,3 +276,53 @@ func TestEnsureDBExists(t *testing.T) {
 		})
 	}
 }
+
+func TestAppValidityPeriods(t *testing.T) {
+	sqlDB := testutil.NewSQLiteDB(t)
+	defer sqlDB.Close()
+
+	db := &MailcloakDB{DB: sqlDB}
+	now := time.Now()
+	past, soon, later := now.Add(-time.Hour).Unix(), now.Add(48*time.Hour).Unix(), now.Add(30*24*time.Hour).Unix()
+
+	testutil.InsertApp(t, sqlDB, "expired", true)
+	testutil.InsertAppFrom(t, sqlDB, "expired", "expired@example.com", true)
+	testutil.SetAppValidity(t, sqlDB, "expired", "", 0, past)
+
+	testutil.InsertApp(t, sqlDB, "future", true)
+	testutil.InsertAppFrom(t, sqlDB, "future", "future@example.com", true)
+	testutil.SetAppValidity(t, sqlDB, "future", "", soon, 0)
+
+	testutil.InsertApp(t, sqlDB, "current", true)
+	testutil.InsertAppFrom(t, sqlDB, "current", "a@example.com", true)
+	testutil.InsertAppFrom(t, sqlDB, "current", "b@example.com", true)
+	testutil.SetAppValidity(t, sqlDB, "current", "", past, later)
+	testutil.SetAppValidity(t, sqlDB, "current", "b@example.com", 0, past)
+
+	cases := []struct {
+		app, from string
+		want      bool
+	}{
+		{"expired", "expired@example.com", false},
+		{"future", "future@example.com", false},
+		{"current", "a@example.com", true},
+		{"current", "b@example.com", false},
+	}
+	for _, tc := range cases {
+		got, err := db.AppFromAllowed(tc.app, tc.from)
+		if err != nil {
+			t.Fatalf("AppFromAllowed error: %v", err)
+		}
+		if got != tc.want {
+			t.Fatalf("AppFromAllowed(%s, %s) = %v, want %v", tc.app, tc.from, got, tc.want)
+		}
+	}
+
+	expiring, err := db.AppsExpiringBefore(now.Add(7 * 24 * time.Hour))
+	if err != nil {
+		t.Fatalf("AppsExpiringBefore error: %v", err)
+	}
+	if len(expiring) != 2 || expiring[0].AppID != "current" || expiring[0].FromAddr != "b@example.com" || expiring[1].AppID != "expired" || expiring[1].FromAddr != "" {
+		t.Fatalf("unexpected expiring entries: %+v", expiring)
+	}
+}
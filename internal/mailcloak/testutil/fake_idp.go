@@ -8,8 +8,13 @@ import (
 type FakeIdentityResolver struct {
 	EmailByUser         map[string]string
 	EmailExistsSet      map[string]bool
+	GroupsByUser        map[string][]string
+	SendDenied          map[string]bool
+	AttributesByUser    map[string]map[string]string
 	ResolveUserEmailErr error
 	EmailExistsErr      error
+	UserGroupsErr       error
+	UserMaySendErr      error
 }
 
 func (f *FakeIdentityResolver) ResolveUserEmail(ctx context.Context, user string) (string, bool, error) {
@@ -35,3 +40,25 @@ func (f *FakeIdentityResolver) EmailExists(ctx context.Context, email string) (b
 	}
 	return f.EmailExistsSet[strings.ToLower(email)], nil
 }
+
+func (f *FakeIdentityResolver) UserGroups(ctx context.Context, user string) ([]string, error) {
+	if f.UserGroupsErr != nil {
+		return nil, f.UserGroupsErr
+	}
+	if f.GroupsByUser == nil {
+		return nil, nil
+	}
+	return f.GroupsByUser[strings.ToLower(user)], nil
+}
+
+func (f *FakeIdentityResolver) UserMaySend(ctx context.Context, user string) (bool, error) {
+	if f.UserMaySendErr != nil {
+		return false, f.UserMaySendErr
+	}
+	return !f.SendDenied[strings.ToLower(user)], nil
+}
+
+func (f *FakeIdentityResolver) UserAttribute(ctx context.Context, user, name string) (string, bool, error) {
+	val, ok := f.AttributesByUser[strings.ToLower(user)][name]
+	return val, ok, nil
+}
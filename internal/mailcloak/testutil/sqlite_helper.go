@@ -12,8 +12,14 @@ import (
 
 const schemaSQL = `
 CREATE TABLE IF NOT EXISTS domains (
-	domain_name TEXT PRIMARY KEY,
-	enabled     INTEGER NOT NULL DEFAULT 1
+	domain_name   TEXT PRIMARY KEY,
+	enabled       INTEGER NOT NULL DEFAULT 1,
+	catchall_user TEXT,
+	max_message_size INTEGER,
+	failure_mode  TEXT,
+	policy_mode   TEXT,
+	max_recipients INTEGER,
+	auth_methods  TEXT
 );
 
 CREATE TABLE IF NOT EXISTS aliases (
@@ -30,20 +36,140 @@ CREATE TABLE IF NOT EXISTS aliases (
 
 CREATE INDEX IF NOT EXISTS idx_aliases_username ON aliases(target_user);
 
+CREATE TABLE IF NOT EXISTS alias_domains (
+	domain_name        TEXT PRIMARY KEY,
+	target_domain_name TEXT NOT NULL,
+	map_senders        INTEGER NOT NULL DEFAULT 0 CHECK (map_senders IN (0,1)),
+	enabled            INTEGER NOT NULL DEFAULT 1 CHECK (enabled IN (0,1)),
+	updated_at         INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+
+	FOREIGN KEY (target_domain_name) REFERENCES domains(domain_name) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS send_as (
+	grantee_type TEXT NOT NULL CHECK (grantee_type IN ('user','group')),
+	grantee      TEXT NOT NULL,
+	address      TEXT NOT NULL,
+	enabled      INTEGER NOT NULL DEFAULT 1 CHECK (enabled IN (0,1)),
+	updated_at   INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+	PRIMARY KEY (grantee_type, grantee, address)
+);
+
+CREATE INDEX IF NOT EXISTS idx_send_as_address ON send_as(address);
+
+CREATE TABLE IF NOT EXISTS internal_only_users (
+	username   TEXT PRIMARY KEY,
+	updated_at INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+);
+
+CREATE TABLE IF NOT EXISTS user_limits (
+	username         TEXT PRIMARY KEY,
+	max_message_size INTEGER,
+	updated_at       INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+);
+
 CREATE TABLE IF NOT EXISTS apps (
 	app_id      TEXT PRIMARY KEY,
 	secret_hash TEXT NOT NULL,
 	enabled     INTEGER NOT NULL DEFAULT 1,
+	max_messages_per_minute   INTEGER,
+	max_messages_per_hour     INTEGER,
+	max_messages_per_day      INTEGER,
+	max_recipients_per_minute INTEGER,
+	max_recipients_per_hour   INTEGER,
+	max_recipients_per_day    INTEGER,
+	not_before                INTEGER,
+	expires_at                INTEGER,
+	max_message_size          INTEGER,
 	created_at  INTEGER NOT NULL
 );
 
 CREATE TABLE IF NOT EXISTS app_from (
-	app_id    TEXT NOT NULL,
-	from_addr TEXT NOT NULL,
-	enabled   INTEGER NOT NULL DEFAULT 1,
+	app_id     TEXT NOT NULL,
+	from_addr  TEXT NOT NULL,
+	enabled    INTEGER NOT NULL DEFAULT 1,
+	not_before INTEGER,
+	expires_at INTEGER,
 	PRIMARY KEY (app_id, from_addr),
 	FOREIGN KEY (app_id) REFERENCES apps(app_id) ON DELETE CASCADE
 );
+
+CREATE TABLE IF NOT EXISTS app_networks (
+	app_id      TEXT NOT NULL,
+	network     TEXT NOT NULL,
+	updated_at  INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+	PRIMARY KEY (app_id, network),
+	FOREIGN KEY (app_id) REFERENCES apps(app_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS app_certs (
+	app_id      TEXT NOT NULL,
+	kind        TEXT NOT NULL CHECK (kind IN ('cert','pubkey')),
+	fingerprint TEXT NOT NULL,
+	enabled     INTEGER NOT NULL DEFAULT 1 CHECK (enabled IN (0,1)),
+	updated_at  INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+	PRIMARY KEY (kind, fingerprint),
+	FOREIGN KEY (app_id) REFERENCES apps(app_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS app_rcpt (
+	app_id      TEXT NOT NULL,
+	pattern     TEXT NOT NULL,
+	enabled     INTEGER NOT NULL DEFAULT 1 CHECK (enabled IN (0,1)),
+	updated_at  INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+	PRIMARY KEY (app_id, pattern),
+	FOREIGN KEY (app_id) REFERENCES apps(app_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS message_log (
+	id              INTEGER PRIMARY KEY AUTOINCREMENT,
+	queue_id        TEXT NOT NULL DEFAULT '',
+	sasl_method     TEXT NOT NULL DEFAULT '',
+	sasl_username   TEXT NOT NULL DEFAULT '',
+	sender          TEXT NOT NULL DEFAULT '',
+	client_address  TEXT NOT NULL DEFAULT '',
+	recipient_count INTEGER NOT NULL DEFAULT 0,
+	size            INTEGER NOT NULL DEFAULT 0,
+	created_at      INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+);
+
+CREATE TABLE IF NOT EXISTS held_messages (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	queue_id       TEXT NOT NULL DEFAULT '',
+	instance       TEXT NOT NULL DEFAULT '',
+	action         TEXT NOT NULL,
+	reason         TEXT NOT NULL DEFAULT '',
+	sasl_username  TEXT NOT NULL DEFAULT '',
+	sender         TEXT NOT NULL DEFAULT '',
+	recipient      TEXT NOT NULL DEFAULT '',
+	client_address TEXT NOT NULL DEFAULT '',
+	created_at     INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+);
+
+CREATE TABLE IF NOT EXISTS rate_events (
+	sasl_username TEXT NOT NULL,
+	instance      TEXT NOT NULL,
+	recipient     TEXT NOT NULL,
+	created_at    INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+	PRIMARY KEY (sasl_username, instance, recipient)
+);
+
+CREATE TABLE IF NOT EXISTS greylist (
+	client_net TEXT NOT NULL,
+	sender     TEXT NOT NULL,
+	recipient  TEXT NOT NULL,
+	first_seen INTEGER NOT NULL,
+	last_seen  INTEGER NOT NULL,
+	PRIMARY KEY (client_net, sender, recipient)
+);
+
+CREATE TABLE IF NOT EXISTS greylist_whitelist (
+	client_net TEXT NOT NULL,
+	sender     TEXT NOT NULL,
+	passed     INTEGER NOT NULL DEFAULT 1,
+	last_seen  INTEGER NOT NULL,
+	PRIMARY KEY (client_net, sender)
+);
 `
 
 func NewSQLiteDB(t *testing.T) *sql.DB {
@@ -71,6 +197,19 @@ PRAGMA synchronous=NORMAL;
 	return db
 }
 
+// Creates a db file with the schema, for code opening the db by path
+func InitSQLiteFile(t *testing.T, path string) {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(schemaSQL); err != nil {
+		t.Fatalf("init schema: %v", err)
+	}
+}
+
 func InsertAlias(t *testing.T, db *sql.DB, aliasEmail, username string, enabled bool) {
 	t.Helper()
 	parts := strings.SplitN(aliasEmail, "@", 2)
@@ -123,3 +262,132 @@ func InsertDomain(t *testing.T, db *sql.DB, domain string, enabled bool) {
 		t.Fatalf("insert domain: %v", err)
 	}
 }
+
+func SetDomainCatchall(t *testing.T, db *sql.DB, domain, username string) {
+	t.Helper()
+	_, err := db.Exec(`UPDATE domains SET catchall_user=? WHERE domain_name=?`, username, domain)
+	if err != nil {
+		t.Fatalf("set domain catch-all: %v", err)
+	}
+}
+
+func InsertAliasDomain(t *testing.T, db *sql.DB, domain, targetDomain string, mapSenders bool) {
+	t.Helper()
+	ms := 0
+	if mapSenders {
+		ms = 1
+	}
+	_, err := db.Exec(`INSERT INTO alias_domains(domain_name, target_domain_name, map_senders) VALUES(?,?,?)`, domain, targetDomain, ms)
+	if err != nil {
+		t.Fatalf("insert alias domain: %v", err)
+	}
+}
+
+func InsertAppNetwork(t *testing.T, db *sql.DB, appID, network string) {
+	t.Helper()
+	_, err := db.Exec(`INSERT INTO app_networks(app_id, network) VALUES(?,?)`, appID, network)
+	if err != nil {
+		t.Fatalf("insert app network: %v", err)
+	}
+}
+
+func InsertAppCert(t *testing.T, db *sql.DB, appID, kind, fingerprint string) {
+	t.Helper()
+	_, err := db.Exec(`INSERT INTO app_certs(app_id, kind, fingerprint) VALUES(?,?,?)`, appID, kind, fingerprint)
+	if err != nil {
+		t.Fatalf("insert app cert: %v", err)
+	}
+}
+
+func InsertInternalOnlyUser(t *testing.T, db *sql.DB, username string) {
+	t.Helper()
+	_, err := db.Exec(`INSERT INTO internal_only_users(username) VALUES(?)`, username)
+	if err != nil {
+		t.Fatalf("insert internal_only_users: %v", err)
+	}
+}
+
+func InsertAppRcpt(t *testing.T, db *sql.DB, appID, pattern string, enabled bool) {
+	t.Helper()
+	en := 0
+	if enabled {
+		en = 1
+	}
+	_, err := db.Exec(`INSERT INTO app_rcpt(app_id, pattern, enabled) VALUES(?,?,?)`, appID, pattern, en)
+	if err != nil {
+		t.Fatalf("insert app_rcpt: %v", err)
+	}
+}
+
+// Sets the validity period of an app, or of one of its sender addresses
+// when fromAddr is not empty. Zero leaves a bound unset.
+func SetAppValidity(t *testing.T, db *sql.DB, appID, fromAddr string, notBefore, expiresAt int64) {
+	t.Helper()
+	nullable := func(v int64) any {
+		if v == 0 {
+			return nil
+		}
+		return v
+	}
+	var err error
+	if fromAddr == "" {
+		_, err = db.Exec(`UPDATE apps SET not_before=?, expires_at=? WHERE app_id=?`, nullable(notBefore), nullable(expiresAt), appID)
+	} else {
+		_, err = db.Exec(`UPDATE app_from SET not_before=?, expires_at=? WHERE app_id=? AND from_addr=?`, nullable(notBefore), nullable(expiresAt), appID, fromAddr)
+	}
+	if err != nil {
+		t.Fatalf("set app validity: %v", err)
+	}
+}
+
+func InsertSendAs(t *testing.T, db *sql.DB, granteeType, grantee, address string, enabled bool) {
+	t.Helper()
+	en := 0
+	if enabled {
+		en = 1
+	}
+	_, err := db.Exec(`INSERT INTO send_as(grantee_type, grantee, address, enabled) VALUES(?,?,?,?)`, granteeType, grantee, address, en)
+	if err != nil {
+		t.Fatalf("insert send_as: %v", err)
+	}
+}
+
+func InsertGreylistTriplet(t *testing.T, db *sql.DB, clientNet, sender, rcpt string, firstSeen int64) {
+	t.Helper()
+	_, err := db.Exec(`INSERT INTO greylist(client_net, sender, recipient, first_seen, last_seen) VALUES(?,?,?,?,?)`, clientNet, sender, rcpt, firstSeen, firstSeen)
+	if err != nil {
+		t.Fatalf("insert greylist triplet: %v", err)
+	}
+}
+
+// Sets the message size limit of a user, app or domain, depending on table
+// ("user_limits", "apps" or "domains")
+func SetMaxMessageSize(t *testing.T, db *sql.DB, table, key string, size int64) {
+	t.Helper()
+	var err error
+	switch table {
+	case "user_limits":
+		_, err = db.Exec(`INSERT INTO user_limits(username, max_message_size) VALUES(?,?)`, key, size)
+	case "apps":
+		_, err = db.Exec(`UPDATE apps SET max_message_size=? WHERE app_id=?`, size, key)
+	case "domains":
+		_, err = db.Exec(`UPDATE domains SET max_message_size=? WHERE domain_name=?`, size, key)
+	default:
+		t.Fatalf("set max message size: unknown table %q", table)
+	}
+	if err != nil {
+		t.Fatalf("set max message size: %v", err)
+	}
+}
+
+func SetDomainSetting(t *testing.T, db *sql.DB, domain, column string, value any) {
+	t.Helper()
+	switch column {
+	case "failure_mode", "policy_mode", "max_recipients", "auth_methods":
+	default:
+		t.Fatalf("set domain setting: unknown column %q", column)
+	}
+	if _, err := db.Exec(`UPDATE domains SET `+column+`=? WHERE domain_name=?`, value, domain); err != nil {
+		t.Fatalf("set domain setting: %v", err)
+	}
+}
@@ -111,7 +111,13 @@ func seedTestDB(t *testing.T, dbPath string) {
 CREATE TABLE IF NOT EXISTS domains (
     domain_name TEXT PRIMARY KEY,
     enabled     INTEGER NOT NULL DEFAULT 1 CHECK (enabled IN (0,1)),
-    updated_at  INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+    updated_at  INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+    catchall_user TEXT,
+    max_message_size INTEGER,
+    failure_mode  TEXT,
+    policy_mode   TEXT,
+    max_recipients INTEGER,
+    auth_methods  TEXT
 );
 CREATE TABLE IF NOT EXISTS aliases (
     alias_email       TEXT PRIMARY KEY,
@@ -124,21 +130,135 @@ CREATE TABLE IF NOT EXISTS aliases (
 CREATE INDEX IF NOT EXISTS idx_aliases_target_user ON aliases(target_user);
 CREATE INDEX IF NOT EXISTS idx_aliases_alias_domain ON aliases(alias_domain_name);
 
+CREATE TABLE IF NOT EXISTS alias_domains (
+    domain_name        TEXT PRIMARY KEY,
+    target_domain_name TEXT NOT NULL,
+    map_senders        INTEGER NOT NULL DEFAULT 0 CHECK (map_senders IN (0,1)),
+    enabled            INTEGER NOT NULL DEFAULT 1 CHECK (enabled IN (0,1)),
+    updated_at         INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+    FOREIGN KEY (target_domain_name) REFERENCES domains(domain_name) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS send_as (
+    grantee_type TEXT NOT NULL CHECK (grantee_type IN ('user','group')),
+    grantee      TEXT NOT NULL,
+    address      TEXT NOT NULL,
+    enabled      INTEGER NOT NULL DEFAULT 1 CHECK (enabled IN (0,1)),
+    updated_at   INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+    PRIMARY KEY (grantee_type, grantee, address)
+);
+CREATE INDEX IF NOT EXISTS idx_send_as_address ON send_as(address);
+
+CREATE TABLE IF NOT EXISTS internal_only_users (
+    username   TEXT PRIMARY KEY,
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+);
+
+CREATE TABLE IF NOT EXISTS user_limits (
+    username         TEXT PRIMARY KEY,
+    max_message_size INTEGER,
+    updated_at       INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+);
+
 CREATE TABLE IF NOT EXISTS apps (
     app_id      TEXT PRIMARY KEY,
     secret_hash TEXT NOT NULL,
     enabled     INTEGER NOT NULL DEFAULT 1 CHECK (enabled IN (0,1)),
-    updated_at  INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+    updated_at  INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+    max_messages_per_minute   INTEGER,
+    max_messages_per_hour     INTEGER,
+    max_messages_per_day      INTEGER,
+    max_recipients_per_minute INTEGER,
+    max_recipients_per_hour   INTEGER,
+    max_recipients_per_day    INTEGER,
+    not_before                INTEGER,
+    expires_at                INTEGER,
+    max_message_size          INTEGER
 );
 CREATE TABLE IF NOT EXISTS app_from (
     app_id      TEXT NOT NULL,
     from_addr   TEXT NOT NULL,
     enabled     INTEGER NOT NULL DEFAULT 1 CHECK (enabled IN (0,1)),
     updated_at  INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+    not_before  INTEGER,
+    expires_at  INTEGER,
     PRIMARY KEY (app_id, from_addr),
     FOREIGN KEY (app_id) REFERENCES apps(app_id) ON DELETE CASCADE
 );
+CREATE TABLE IF NOT EXISTS app_networks (
+    app_id      TEXT NOT NULL,
+    network     TEXT NOT NULL,
+    updated_at  INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+    PRIMARY KEY (app_id, network),
+    FOREIGN KEY (app_id) REFERENCES apps(app_id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS app_certs (
+    app_id      TEXT NOT NULL,
+    kind        TEXT NOT NULL CHECK (kind IN ('cert','pubkey')),
+    fingerprint TEXT NOT NULL,
+    enabled     INTEGER NOT NULL DEFAULT 1 CHECK (enabled IN (0,1)),
+    updated_at  INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+    PRIMARY KEY (kind, fingerprint),
+    FOREIGN KEY (app_id) REFERENCES apps(app_id) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS app_rcpt (
+    app_id      TEXT NOT NULL,
+    pattern     TEXT NOT NULL,
+    enabled     INTEGER NOT NULL DEFAULT 1 CHECK (enabled IN (0,1)),
+    updated_at  INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+    PRIMARY KEY (app_id, pattern),
+    FOREIGN KEY (app_id) REFERENCES apps(app_id) ON DELETE CASCADE
+);
 CREATE INDEX IF NOT EXISTS idx_app_from_from_addr ON app_from(from_addr);
+CREATE TABLE IF NOT EXISTS message_log (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    queue_id        TEXT NOT NULL DEFAULT '',
+    sasl_method     TEXT NOT NULL DEFAULT '',
+    sasl_username   TEXT NOT NULL DEFAULT '',
+    sender          TEXT NOT NULL DEFAULT '',
+    client_address  TEXT NOT NULL DEFAULT '',
+    recipient_count INTEGER NOT NULL DEFAULT 0,
+    size            INTEGER NOT NULL DEFAULT 0,
+    created_at      INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+);
+
+CREATE TABLE IF NOT EXISTS held_messages (
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    queue_id       TEXT NOT NULL DEFAULT '',
+    instance       TEXT NOT NULL DEFAULT '',
+    action         TEXT NOT NULL,
+    reason         TEXT NOT NULL DEFAULT '',
+    sasl_username  TEXT NOT NULL DEFAULT '',
+    sender         TEXT NOT NULL DEFAULT '',
+    recipient      TEXT NOT NULL DEFAULT '',
+    client_address TEXT NOT NULL DEFAULT '',
+    created_at     INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+);
+CREATE INDEX IF NOT EXISTS idx_held_messages_instance ON held_messages(instance);
+CREATE TABLE IF NOT EXISTS rate_events (
+    sasl_username TEXT NOT NULL,
+    instance      TEXT NOT NULL,
+    recipient     TEXT NOT NULL,
+    created_at    INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+    PRIMARY KEY (sasl_username, instance, recipient)
+);
+
+CREATE TABLE IF NOT EXISTS greylist (
+    client_net TEXT NOT NULL,
+    sender     TEXT NOT NULL,
+    recipient  TEXT NOT NULL,
+    first_seen INTEGER NOT NULL,
+    last_seen  INTEGER NOT NULL,
+    PRIMARY KEY (client_net, sender, recipient)
+);
+
+CREATE TABLE IF NOT EXISTS greylist_whitelist (
+    client_net TEXT NOT NULL,
+    sender     TEXT NOT NULL,
+    passed     INTEGER NOT NULL DEFAULT 1,
+    last_seen  INTEGER NOT NULL,
+    PRIMARY KEY (client_net, sender)
+);
 `
 	if _, err := db.Exec(schema); err != nil {
 		t.Fatalf("schema exec: %v", err)
@@ -199,12 +319,22 @@ func policyQuery(t *testing.T, sockPath string, kv map[string]string) string {
 		t.Fatalf("write: %v", err)
 	}
 
+	// The server keeps the connection open for further requests,
+	// so read a single response up to its terminating empty line.
 	_ = conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-	resp, err := io.ReadAll(conn)
-	if err != nil {
-		t.Fatalf("read: %v", err)
+	r := bufio.NewReader(conn)
+	var resp strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if line == "\n" {
+			break
+		}
+		resp.WriteString(line)
 	}
-	return string(resp)
+	return resp.String()
 }
 
 type fakeKCMode int